@@ -0,0 +1,99 @@
+package hoconenv
+
+import "strings"
+
+var (
+	parseAnnotations = false
+
+	// annotations holds the @name value annotations attached to each lowercased key
+	annotations = make(map[string]map[string]string)
+)
+
+// SetParseAnnotations enables collecting annotation comments such as "# @since 2.0" or
+// "// @deprecated use database.uri". Annotations attach to the next key or block in the file
+// and are reported by Annotations. Comments not starting with "@" are always ignored
+func SetParseAnnotations(enabled bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	parseAnnotations = enabled
+}
+
+// Annotations returns the annotations attached to key, mapping each name without the "@" to
+// its value, or nil if it has none. Annotations without a value map to an empty string
+func Annotations(key string) map[string]string {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	key = strings.ToLower(key)
+	found, exists := annotations[key]
+	if !exists {
+		found = annotations[stripPrefix(key)]
+	}
+
+	if found == nil {
+		return nil
+	}
+
+	copied := make(map[string]string, len(found))
+	for name, value := range found {
+		copied[name] = value
+	}
+	return copied
+}
+
+// parseAnnotation extracts the name and value of an annotation comment
+func parseAnnotation(comment string) (string, string, bool) {
+	comment = strings.TrimSpace(trimCommentPrefix(comment))
+
+	if !strings.HasPrefix(comment, "@") || len(comment) == 1 {
+		return "", "", false
+	}
+
+	name, value := comment[1:], ""
+	if i := strings.IndexAny(name, " \t"); i != -1 {
+		name, value = name[:i], strings.TrimSpace(name[i:])
+	}
+	return name, value, true
+}
+
+// collectAnnotation remembers an annotation comment for the next key
+func (s *parseState) collectAnnotation(comment string) {
+	name, value, ok := parseAnnotation(comment)
+	if !ok {
+		return
+	}
+
+	// @env names the key's environment variable even when annotations aren't collected
+	if name == "env" {
+		s.envName = value
+	}
+
+	if !s.annotate {
+		return
+	}
+
+	if s.annotations == nil {
+		s.annotations = make(map[string]string)
+	}
+	s.annotations[name] = value
+}
+
+// attachAnnotations attaches the collected annotations to fullKey
+func (s *parseState) attachAnnotations(fullKey string) {
+	if len(s.annotations) == 0 {
+		return
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	key := strings.ToLower(fullKey)
+	if annotations[key] == nil {
+		annotations[key] = make(map[string]string)
+	}
+	for name, value := range s.annotations {
+		annotations[key][name] = value
+	}
+
+	s.annotations = nil
+}
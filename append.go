@@ -0,0 +1,109 @@
+package hoconenv
+
+import (
+	"fmt"
+	"strings"
+)
+
+// cutAppendKey reports whether key was written as "key +=", returning the key without the "+"
+func cutAppendKey(key string) (string, bool) {
+	if trimmed, ok := strings.CutSuffix(key, "+"); ok {
+		return strings.TrimSpace(trimmed), true
+	}
+	return key, false
+}
+
+// storeAppend records a key += value assignment. A literal element is appended to the current
+// value straight away, including values from files loaded earlier. When the element has
+// substitutions or the key is still waiting to be resolved, the append is resolved with the
+// other pending values, after the earlier assignments it builds on
+func storeAppend(fullKey string, value rawValue) error {
+	mutex.Lock()
+	if _, isPending := pendingValues[fullKey]; !isPending && !value.substitute {
+		defer mutex.Unlock()
+
+		_, previous, exists := findVariable(fullKey)
+		appended, err := appendElement(previous, exists, isArrayValue(fullKey), value.value)
+		if err != nil {
+			return fmt.Errorf("cannot append to %s: %w", fullKey, err)
+		}
+
+		setVariable(fullKey, appended, value.origin, value.priority, true)
+		return nil
+	}
+	mutex.Unlock()
+
+	value.appended = true
+	storePending(fullKey, value)
+	return nil
+}
+
+// resolveRaw resolves a pending value and reports whether the result is an array. An append
+// resolves the assignment it builds on first, which is either an earlier pending value or the
+// stored one. The caller must hold the mutex
+func resolveRaw(key string, value rawValue, visiting map[string]bool) (string, []string, bool, bool) {
+	element, missing, ok := value.value, []string(nil), true
+	if value.substitute {
+		element, missing, ok = resolveSubstitutions(value.value, value.scope, visiting)
+	}
+	if !value.appended {
+		return element, missing, ok, value.array || (value.substitute && substitutesArray(value, visiting))
+	}
+
+	var previous string
+	var exists, isArray bool
+	if value.base != nil {
+		var baseMissing []string
+		previous, baseMissing, exists, isArray = resolveRaw(key, *value.base, visiting)
+		missing = append(baseMissing, missing...)
+	} else {
+		_, previous, exists = findVariable(key)
+		isArray = isArrayValue(key)
+	}
+
+	// An undefined optional substitution appends nothing
+	if !ok {
+		return previous, missing, exists, isArray
+	}
+
+	appended, err := appendElement(previous, exists, isArray, element)
+	if err != nil {
+		recordWarning("Cannot append to %s: %v", key, err)
+		return previous, missing, exists, isArray
+	}
+
+	return appended, missing, true, true
+}
+
+// appendElement appends element to the array literal previous, starting a new array if the key
+// has no value yet
+func appendElement(previous string, exists, isArray bool, element string) (string, error) {
+	element = quoteElement(element)
+	if !exists {
+		return "[" + element + "]", nil
+	}
+
+	if !isArray {
+		return "", fmt.Errorf("value %q is not an array", previous)
+	}
+
+	inner := strings.TrimSpace(previous)
+	inner = strings.TrimSuffix(strings.TrimSpace(inner[1:len(inner)-1]), ",")
+	if strings.TrimSpace(inner) == "" {
+		return "[" + element + "]", nil
+	}
+
+	return "[" + inner + ", " + element + "]", nil
+}
+
+// elementEscaper escapes backslashes and double quotes inside a quoted array element
+var elementEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"")
+
+// quoteElement quotes an element that would otherwise be split or trimmed by parseArray,
+// escaping it so unquoteElement gives back the same string
+func quoteElement(element string) string {
+	if element == "" || element != strings.TrimSpace(element) || strings.ContainsAny(element, ",[]{}\"'") {
+		return "\"" + elementEscaper.Replace(element) + "\""
+	}
+	return element
+}
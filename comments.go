@@ -0,0 +1,77 @@
+package hoconenv
+
+import "strings"
+
+// commentPrefixes are the markers that start a comment
+var commentPrefixes = []string{"#", "//"}
+
+// SetCommentPrefixes replaces the markers that start a comment, "#" and "//" by default, for
+// example with ";" for INI-style files. The same rules apply to every prefix: a whole-line
+// comment starts with it, and an inline comment needs whitespace before it and is never
+// recognized inside quotes. Calling it without prefixes restores the defaults
+func SetCommentPrefixes(prefixes ...string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if len(prefixes) == 0 {
+		commentPrefixes = []string{"#", "//"}
+		return
+	}
+	commentPrefixes = append([]string(nil), prefixes...)
+}
+
+// currentCommentPrefixes returns the configured comment prefixes
+func currentCommentPrefixes() []string {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return commentPrefixes
+}
+
+// isComment reports whether line is a whole-line comment
+func isComment(line string) bool {
+	return hasCommentPrefix(line, currentCommentPrefixes())
+}
+
+// trimCommentPrefix removes the comment prefix from a whole-line comment
+func trimCommentPrefix(line string) string {
+	for _, prefix := range currentCommentPrefixes() {
+		if rest, ok := strings.CutPrefix(line, prefix); ok {
+			return rest
+		}
+	}
+	return line
+}
+
+// hasCommentPrefix reports whether s starts with one of prefixes
+func hasCommentPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if prefix != "" && strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// scanComment returns the index of the inline comment in line, or -1 if there is none, and
+// whether line ends inside a double-quoted string
+func scanComment(line string) (int, bool) {
+	prefixes := currentCommentPrefixes()
+
+	inQuotes := false
+	for i := 0; i < len(line); i++ {
+		switch {
+		case inQuotes && line[i] == '\\':
+			i++ // An escaped character can't close the string
+		case line[i] == '"':
+			inQuotes = !inQuotes
+		case inQuotes:
+			continue
+		case hasCommentPrefix(line[i:], prefixes):
+			if i == 0 || line[i-1] == ' ' || line[i-1] == '\t' {
+				return i, false
+			}
+		}
+	}
+
+	return -1, inQuotes
+}
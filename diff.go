@@ -0,0 +1,96 @@
+package hoconenv
+
+import (
+	"maps"
+	"sort"
+)
+
+// Snapshot is a copy of the loaded configuration at one point in time, for comparing with Diff
+type Snapshot struct {
+	values  map[string]string
+	secrets map[string]bool
+}
+
+// ChangeKind is the kind of difference a Change describes
+type ChangeKind int
+
+const (
+	// Added is a key that only the newer snapshot has
+	Added ChangeKind = iota
+
+	// Removed is a key that only the older snapshot has
+	Removed
+
+	// Modified is a key whose value differs between the snapshots
+	Modified
+)
+
+// String returns the name of the change kind
+func (k ChangeKind) String() string {
+	switch k {
+	case Added:
+		return "added"
+	case Removed:
+		return "removed"
+	default:
+		return "modified"
+	}
+}
+
+// Change is a key that differs between two snapshots. Old is empty for added keys and New is
+// empty for removed keys
+type Change struct {
+	Key  string
+	Kind ChangeKind
+	Old  string
+	New  string
+}
+
+// TakeSnapshot copies the loaded configuration, keyed by the lowercased key without the prefix
+func TakeSnapshot() *Snapshot {
+	values := snapshotVariables()
+
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	return &Snapshot{values: values, secrets: maps.Clone(secrets)}
+}
+
+// Diff returns the keys that were added, removed or modified from s to other, sorted by key.
+// Keys marked secret in either snapshot are reported when they change, with both values
+// written as "***"
+func (s *Snapshot) Diff(other *Snapshot) []Change {
+	var changes []Change
+	for key, old := range s.values {
+		value, exists := other.values[key]
+		switch {
+		case !exists:
+			changes = append(changes, Change{Key: key, Kind: Removed, Old: old})
+		case value != old:
+			changes = append(changes, Change{Key: key, Kind: Modified, Old: old, New: value})
+		}
+	}
+
+	for key, value := range other.values {
+		if _, exists := s.values[key]; !exists {
+			changes = append(changes, Change{Key: key, Kind: Added, New: value})
+		}
+	}
+
+	for i, change := range changes {
+		if s.secrets[change.Key] || other.secrets[change.Key] {
+			if change.Kind != Added {
+				changes[i].Old = redacted
+			}
+			if change.Kind != Removed {
+				changes[i].New = redacted
+			}
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Key < changes[j].Key
+	})
+
+	return changes
+}
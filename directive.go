@@ -0,0 +1,70 @@
+package hoconenv
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DirectiveFunc handles a custom directive line. args is the text following the directive name,
+// and set assigns a value to a key relative to the enclosing object, exactly like a
+// key = value line at the same position would
+type DirectiveFunc func(args string, set func(key, value string)) error
+
+// directives holds the custom directives registered with RegisterDirective
+var directives = make(map[string]DirectiveFunc)
+
+// RegisterDirective registers fn to handle config lines that start with name. For example, after
+// registering "set_default", the line "set_default timeout = 30s" calls fn with args
+// "timeout = 30s". A line where name is directly followed by "=" is still an ordinary assignment
+func RegisterDirective(name string, fn DirectiveFunc) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	directives[name] = fn
+}
+
+// lookupDirective returns the registered directive handler for line, if any, along with its arguments
+func lookupDirective(line string) (DirectiveFunc, string, bool) {
+	name, args, found := strings.Cut(line, " ")
+	if !found {
+		return nil, "", false
+	}
+
+	args = strings.TrimSpace(args)
+	if strings.HasPrefix(args, "=") {
+		return nil, "", false
+	}
+
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	fn, exists := directives[name]
+	return fn, args, exists
+}
+
+// runDirective invokes a custom directive handler, storing any values it sets under the current scope
+func runDirective(fn DirectiveFunc, args string, state *parseState, filePath string, lineNum int) error {
+	// With Parse, keys set by the directive go to the handler. The first error from storing a key
+	// or from the handler stops parsing
+	var setErr error
+	set := func(key, value string) {
+		if setErr != nil {
+			return
+		}
+
+		fullKey := buildFullKey(state.keyStack, key)
+		if state.handler == nil {
+			setErr = state.set(fullKey, value, location(filePath, lineNum), false)
+		} else {
+			setErr = state.handler(fullKey, value)
+		}
+	}
+
+	if err := fn(args, set); err != nil {
+		return fmt.Errorf("directive failed at %s:%d: %w", filePath, lineNum, err)
+	}
+
+	if setErr != nil && state.handler == nil {
+		return fmt.Errorf("%w at %s:%d", setErr, filePath, lineNum)
+	}
+	return setErr
+}
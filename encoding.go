@@ -0,0 +1,75 @@
+package hoconenv
+
+import (
+	"fmt"
+	"io"
+	"mime"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// fileEncoding is the encoding config files are decoded from; nil means UTF-8
+var fileEncoding encoding.Encoding
+
+// SetEncoding configures the character encoding of config files, e.g. "ISO-8859-1" or "UTF-16".
+// Names are resolved using the IANA registry. An empty name restores the UTF-8 default
+func SetEncoding(enc string) error {
+	decoded, err := lookupEncoding(enc)
+	if err != nil {
+		return err
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	fileEncoding = decoded
+
+	return nil
+}
+
+// lookupEncoding resolves an encoding name, returning nil for UTF-8
+func lookupEncoding(name string) (encoding.Encoding, error) {
+	if name == "" {
+		return nil, nil
+	}
+
+	enc, err := ianaindex.IANA.Encoding(name)
+	if err != nil || enc == nil {
+		return nil, fmt.Errorf("unsupported encoding %s", name)
+	}
+
+	if enc == unicode.UTF8 {
+		return nil, nil
+	}
+
+	return enc, nil
+}
+
+// decodeReader wraps r so it yields UTF-8 when enc is set
+func decodeReader(r io.Reader, enc encoding.Encoding) io.Reader {
+	if enc == nil {
+		return r
+	}
+
+	return transform.NewReader(r, enc.NewDecoder())
+}
+
+// configuredEncoding returns the encoding set with SetEncoding
+func configuredEncoding() encoding.Encoding {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return fileEncoding
+}
+
+// contentTypeEncoding returns the encoding named by the charset parameter of a Content-Type
+// header, falling back to the configured encoding when there is none
+func contentTypeEncoding(contentType string) (encoding.Encoding, error) {
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil || params["charset"] == "" {
+		return configuredEncoding(), nil
+	}
+
+	return lookupEncoding(params["charset"])
+}
@@ -0,0 +1,307 @@
+package hoconenv
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// envNames holds the environment variable names set for lowercased keys with SetEnvNameFor or @env
+var envNames = make(map[string]string)
+
+// EnvName returns the name of the environment variable a config key is applied to
+func EnvName(key string) string {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return envName(key)
+}
+
+// SetEnvNameFor applies key to the environment variable name as written instead of the name
+// derived from the key, for tools that expect a fixed variable. The same can be done in the
+// configuration with an "# @env NAME" comment above the key. An empty name restores the default
+func SetEnvNameFor(key, name string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if name == "" {
+		delete(envNames, strings.ToLower(key))
+		return
+	}
+	envNames[strings.ToLower(key)] = name
+}
+
+// KeyCasePolicy selects how the case of config keys carries over to environment variable names
+type KeyCasePolicy int
+
+const (
+	// KeyCaseLowerAll lowercases the whole key, so database.URL becomes database.url
+	KeyCaseLowerAll KeyCasePolicy = iota
+
+	// KeyCaseAsIs keeps the key as written, so Database.URL stays Database.URL
+	KeyCaseAsIs
+
+	// KeyCaseLowerLeaf lowercases only the last segment, so Database.URL becomes Database.url
+	KeyCaseLowerLeaf
+)
+
+// keyCasePolicy is how envName treats the case of keys
+var keyCasePolicy = KeyCaseLowerAll
+
+// SetKeyCasePolicy sets how the case of config keys carries over to environment variable names.
+// The default, KeyCaseLowerAll, lowercases the whole key. With the other policies, keys that
+// differ in case can map to separate variables, and reading a key with the exact case it was
+// written in returns its own value. Reads in any other case still find the key
+func SetKeyCasePolicy(policy KeyCasePolicy) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	keyCasePolicy = policy
+}
+
+// envName derives the environment variable name for key, passing it through the sanitizer if
+// one is set. The caller must hold the mutex
+func envName(key string) string {
+	name := rawEnvName(key)
+	if envNameSanitizer != nil {
+		return envNameSanitizer(name)
+	}
+	return name
+}
+
+// rawEnvName derives the environment variable name for key before sanitizing. The caller must hold the mutex
+func rawEnvName(key string) string {
+	if name, exists := envNames[strings.ToLower(key)]; exists {
+		return name
+	}
+
+	switch keyCasePolicy {
+	case KeyCaseAsIs:
+		return prefix + key
+	case KeyCaseLowerLeaf:
+		i := strings.LastIndexByte(key, '.')
+		return prefix + key[:i+1] + strings.ToLower(key[i+1:])
+	default:
+		return prefix + strings.ToLower(key)
+	}
+}
+
+// envFallback makes accessors read keys missing from the configuration from the environment
+var envFallback bool
+
+// SetEnvFallback makes the accessors read a key that is missing from the configuration from the
+// environment variable it would be applied to, as named by EnvName, before falling back to the
+// default. This puts file configuration and the real environment behind the same lookup
+func SetEnvFallback(enabled bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	envFallback = enabled
+}
+
+var (
+	// strictEnvNames makes a load fail if a key maps to a name that isn't a valid POSIX variable name
+	strictEnvNames bool
+
+	// envNameSanitizer rewrites every derived environment variable name, if set
+	envNameSanitizer func(name string) string
+)
+
+// SetStrictEnvNames makes a load fail if any key maps to an environment variable name that
+// doesn't match the POSIX pattern [A-Za-z_][A-Za-z0-9_]*. Dotted names such as database.url
+// are accepted by os.Setenv but rejected by many shells and tools. Names are checked after
+// the sanitizer set with SetEnvNameSanitizer, so the two can be combined
+func SetStrictEnvNames(enabled bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	strictEnvNames = enabled
+}
+
+// SetEnvNameSanitizer rewrites every environment variable name derived from a key, including
+// names set with SetEnvNameFor or @env, with sanitize. SanitizeEnvName is a built-in
+// sanitizer producing valid POSIX names. A nil sanitizer restores the default
+func SetEnvNameSanitizer(sanitize func(name string) string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	envNameSanitizer = sanitize
+}
+
+// SanitizeEnvName replaces every character of name that isn't valid in a POSIX environment
+// variable name with an underscore, and prepends one if name starts with a digit, so
+// database.url becomes database_url and 2fa-code becomes _2fa_code
+func SanitizeEnvName(name string) string {
+	sanitized := []byte(name)
+	for i, c := range sanitized {
+		if !isEnvNameChar(c) {
+			sanitized[i] = '_'
+		}
+	}
+
+	if len(sanitized) == 0 || (sanitized[0] >= '0' && sanitized[0] <= '9') {
+		return "_" + string(sanitized)
+	}
+	return string(sanitized)
+}
+
+// isValidEnvName reports whether name matches [A-Za-z_][A-Za-z0-9_]*
+func isValidEnvName(name string) bool {
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		return false
+	}
+
+	for i := 0; i < len(name); i++ {
+		if !isEnvNameChar(name[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// isEnvNameChar reports whether c may appear in a POSIX environment variable name
+func isEnvNameChar(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// checkEnvNames returns an error listing the keys whose environment variable names are
+// invalid, if strict names are enabled
+func checkEnvNames() error {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	if !strictEnvNames {
+		return nil
+	}
+
+	keys := make([]string, 0, len(variables))
+	for key := range variables {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var invalid []string
+	for _, key := range keys {
+		if name := envName(key); !isValidEnvName(name) {
+			invalid = append(invalid, fmt.Sprintf("%s (key %s)", name, key))
+		}
+	}
+
+	if len(invalid) > 0 {
+		return fmt.Errorf("invalid environment variable names: %s", strings.Join(invalid, ", "))
+	}
+	return nil
+}
+
+// attachEnvName applies the name from a preceding @env comment to fullKey
+func (s *parseState) attachEnvName(fullKey string) {
+	if s.envName == "" {
+		return
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	envNames[strings.ToLower(fullKey)] = s.envName
+	s.envName = ""
+}
+
+// ImportEnv seeds the configuration from environment variables carrying the prefix, mapping each
+// name back to its key as the inverse of EnvName: with prefix "prod", prod.database.url is
+// imported as database.url. Upper-snake names such as PROD_DATABASE_URL, which shells can set,
+// are imported too, reading each underscore as a dot, so they can't name keys containing
+// underscores; a dotted name wins over an upper-snake one for the same key. Call it before Load
+// so files can override or reference the imported values. A prefix is required, since without
+// one every variable would be imported
+func ImportEnv() error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if err := checkFrozen("import the environment"); err != nil {
+		return err
+	}
+
+	if prefix == "" {
+		return fmt.Errorf("ImportEnv requires a prefix, set one with SetPrefix")
+	}
+
+	snakePrefix := strings.ToUpper(strings.ReplaceAll(prefix, ".", "_"))
+	dotted := make(map[string]bool)
+	var snake []string
+	for _, entry := range os.Environ() {
+		name, value, _ := strings.Cut(entry, "=")
+		if strings.HasPrefix(name, snakePrefix) {
+			snake = append(snake, entry)
+			continue
+		}
+
+		key := stripPrefix(name)
+		if key == name || key == "" {
+			continue
+		}
+
+		key = strings.ToLower(key)
+		dotted[key] = true
+		setVariable(key, value, "env:"+name, 0, false)
+	}
+
+	for _, entry := range snake {
+		name, value, _ := strings.Cut(entry, "=")
+		key := strings.ToLower(strings.ReplaceAll(strings.TrimPrefix(name, snakePrefix), "_", "."))
+		if key == "" || dotted[key] {
+			continue
+		}
+
+		setVariable(key, value, "env:"+name, 0, false)
+	}
+
+	return nil
+}
+
+// ArrayEnvStyle selects how array values are applied to environment variables
+type ArrayEnvStyle int
+
+const (
+	// ArrayEnvLiteral sets the variable to the array literal as written, e.g. [ "a", "b" ]
+	ArrayEnvLiteral ArrayEnvStyle = iota
+
+	// ArrayEnvJoined sets the variable to the elements joined with commas, e.g. a,b
+	ArrayEnvJoined
+
+	// ArrayEnvIndexed sets NAME_0, NAME_1, ... to the elements and NAME_COUNT to their number
+	ArrayEnvIndexed
+)
+
+// arrayEnvStyle is how applyVariables applies array values
+var arrayEnvStyle = ArrayEnvJoined
+
+// SetArrayEnvStyle sets how array literal values are applied to environment variables. The
+// default, ArrayEnvJoined, joins their elements with commas. Accessors such as GetIndex and GetLen read
+// the configuration rather than the environment, so they work the same with every style
+func SetArrayEnvStyle(style ArrayEnvStyle) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	arrayEnvStyle = style
+}
+
+// envAssignment is an environment variable to set
+type envAssignment struct {
+	name  string
+	value string
+}
+
+// arrayEnvValues returns the environment variables to set for the value of the variable name,
+// expanding array values according to the array style. The caller must hold the mutex
+func arrayEnvValues(name, value string, array bool) []envAssignment {
+	elements, isArray := parseArray(value)
+	if !array || !isArray || arrayEnvStyle == ArrayEnvLiteral {
+		return []envAssignment{{name: name, value: value}}
+	}
+
+	if arrayEnvStyle == ArrayEnvJoined {
+		return []envAssignment{{name: name, value: strings.Join(elements, ",")}}
+	}
+
+	values := make([]envAssignment, 0, len(elements)+1)
+	for i, element := range elements {
+		values = append(values, envAssignment{name: name + "_" + strconv.Itoa(i), value: element})
+	}
+	return append(values, envAssignment{name: name + "_COUNT", value: strconv.Itoa(len(elements))})
+}
@@ -0,0 +1,44 @@
+package hoconenv
+
+import "errors"
+
+// Sentinel errors for telling load failures apart with errors.Is. The returned errors carry
+// the details, such as the file and line, and wrap the matching sentinel
+var (
+	// ErrFileNotFound is returned when a config file passed to Load or included doesn't exist
+	ErrFileNotFound = errors.New("file does not exist")
+
+	// ErrSyntax is returned for malformed HOCON or JSON
+	ErrSyntax = errors.New("invalid syntax")
+
+	// ErrIncludeFailed is returned when a required include can't be loaded
+	ErrIncludeFailed = errors.New("include failed")
+
+	// ErrURLFetch is returned when a required URL include can't be fetched
+	ErrURLFetch = errors.New("failed to fetch URL")
+
+	// ErrFrozen is returned by operations that modify the configuration after Freeze
+	ErrFrozen = errors.New("configuration is frozen")
+)
+
+// markedError makes err match sentinel with errors.Is while keeping err's message
+type markedError struct {
+	sentinel error
+	err      error
+}
+
+func (e *markedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *markedError) Unwrap() []error {
+	return []error{e.sentinel, e.err}
+}
+
+// markError returns err marked with sentinel, or nil if err is nil
+func markError(sentinel, err error) error {
+	if err == nil || errors.Is(err, sentinel) {
+		return err
+	}
+	return &markedError{sentinel: sentinel, err: err}
+}
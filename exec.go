@@ -0,0 +1,97 @@
+package hoconenv
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// allowExec enables @exec("command") values, which run commands while loading
+var allowExec bool
+
+// SetAllowExec enables values of the form @exec("command"), which run the command at load time
+// and use its trimmed stdout as the value. Commands run with the permissions of the process,
+// so only enable this for config files that are as trusted as the program itself
+func SetAllowExec(enabled bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	allowExec = enabled
+}
+
+// parseExec returns the command of an @exec("command") or optional @exec?("command") value
+func parseExec(value string) (command string, optional bool, ok bool, err error) {
+	rest, found := strings.CutPrefix(value, "@exec")
+	if !found {
+		return "", false, false, nil
+	}
+
+	rest, optional = strings.CutPrefix(rest, "?")
+	_, args, isCall, err := parseFunctionCall("exec" + rest)
+	if !isCall {
+		return "", false, false, nil
+	}
+	if err != nil {
+		return "", false, true, err
+	}
+	if len(args) != 1 {
+		return "", false, true, fmt.Errorf("@exec takes 1 argument, got %d", len(args))
+	}
+
+	return args[0], optional, true, nil
+}
+
+// runExec runs command directly, without a shell, and returns its trimmed stdout. A non-zero
+// exit is reported along with the command's stderr
+func runExec(command string) (string, error) {
+	mutex.RLock()
+	allowed := allowExec
+	mutex.RUnlock()
+
+	if !allowed {
+		return "", fmt.Errorf("@exec is disabled, enable it with SetAllowExec")
+	}
+
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return "", fmt.Errorf("empty @exec command")
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(fields[0], fields[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return "", fmt.Errorf("command %q failed: %w: %s", command, err, message)
+		}
+		return "", fmt.Errorf("command %q failed: %w", command, err)
+	}
+
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// execValue resolves an @exec value in place. An optional command that fails leaves the key
+// unset with a warning, which is reported through the returned bool
+func execValue(parsed *rawValue, filePath string, lineNum int) (bool, error) {
+	command, optional, ok, err := parseExec(parsed.value)
+	if err != nil {
+		return false, fmt.Errorf("%w at %s:%d", err, filePath, lineNum)
+	}
+	if !ok {
+		return true, nil
+	}
+
+	value, err := runExec(command)
+	if err != nil {
+		if optional {
+			warn("Optional @exec value at %s:%d skipped: %v", filePath, lineNum, err)
+			return false, nil
+		}
+		return false, fmt.Errorf("%w at %s:%d", err, filePath, lineNum)
+	}
+
+	parsed.value = value
+	return true, nil
+}
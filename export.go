@@ -0,0 +1,351 @@
+package hoconenv
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Export writes the current merged configuration to w in HOCON format, one key per line sorted by key.
+// Values of keys marked secret are written as "***", use WriteFile to write the real values
+func Export(w io.Writer) error {
+	return export(w, true)
+}
+
+// export writes the configuration to w in HOCON format, redacting secret values if redact is set
+func export(w io.Writer, redact bool) error {
+	snapshot, arrays := snapshotVariables(), snapshotArrays()
+	if redact {
+		redactSecrets(snapshot)
+	}
+
+	keys := make([]string, 0, len(snapshot))
+	for key := range snapshot {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	writer := bufio.NewWriter(w)
+	for _, key := range keys {
+		// Arrays are written unquoted so they load back as arrays
+		format := "%s = \"%s\"\n"
+		if arrays[key] && snapshot[key] != redacted {
+			format = "%s = %s\n"
+		}
+		if _, err := fmt.Fprintf(writer, format, key, snapshot[key]); err != nil {
+			return fmt.Errorf("failed to export key %s: %w", key, err)
+		}
+	}
+
+	return writer.Flush()
+}
+
+// WriteFile atomically writes the current merged configuration to path in HOCON format. Unlike
+// Export, secret values are written as they are, so the file can be loaded back as the resolved
+// configuration. It is created with 0644 permissions unless perm is given
+func WriteFile(path string, perm ...os.FileMode) error {
+	mode := os.FileMode(0644)
+	if len(perm) > 0 {
+		mode = perm[0]
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file for %s: %w", path, err)
+	}
+
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath) // No-op once the rename has succeeded
+
+	if err := export(tmp, false); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write config file %s: %w", path, err)
+	}
+
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to set permissions on %s: %w", path, err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write config file %s: %w", path, err)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to write config file %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// Fingerprint returns a SHA-256 hex digest of the sorted key-value pairs of the current
+// configuration, so identical configurations hash the same regardless of file order.
+// Secret values are included in the hash
+func Fingerprint() string {
+	snapshot := snapshotVariables()
+
+	keys := make([]string, 0, len(snapshot))
+	for key := range snapshot {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	hash := sha256.New()
+	for _, key := range keys {
+		// NUL can't appear in a text config, so it unambiguously separates keys and values
+		hash.Write([]byte(key + "\x00" + snapshot[key] + "\x00"))
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// DumpSorted writes the configuration to w as name=value lines sorted by name, using the
+// environment variable names the keys are applied to, for line-based diffs between two
+// configurations. Values of keys marked secret are written as "***", and backslashes, newlines
+// and carriage returns are escaped so every variable stays on one line
+func DumpSorted(w io.Writer) error {
+	mutex.RLock()
+	keys := make([]string, 0, len(variables))
+	for key := range variables {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// Of keys applied to the same variable, the last in key order wins, as in applyVariables
+	env := make(map[string]string, len(keys))
+	for _, key := range keys {
+		value, array := variables[key], arrayKeys[key]
+		if secrets[strings.ToLower(key)] {
+			value, array = redacted, false
+		}
+		for _, variable := range arrayEnvValues(envName(key), value, array) {
+			env[variable.name] = variable.value
+		}
+	}
+	mutex.RUnlock()
+
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	escaper := strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\r", "\\r")
+	writer := bufio.NewWriter(w)
+	for _, name := range names {
+		if _, err := fmt.Fprintf(writer, "%s=%s\n", name, escaper.Replace(env[name])); err != nil {
+			return fmt.Errorf("failed to dump %s: %w", name, err)
+		}
+	}
+
+	return writer.Flush()
+}
+
+// GetJSON returns the subtree rooted at key serialized as a JSON object.
+// Scalar keys are returned as a JSON string
+func GetJSON(key string) (string, error) {
+	runLazyLoaders(key)
+
+	snapshot := snapshotVariables()
+	key = snapshotKey(snapshot, key)
+
+	if value, exists := snapshot[key]; exists {
+		markUsed(key)
+		data, err := json.Marshal(value)
+		if err != nil {
+			return "", fmt.Errorf("failed to encode key %s as JSON: %w", key, err)
+		}
+		return string(data), nil
+	}
+
+	subtree := make(map[string]string)
+	for k, value := range snapshot {
+		if strings.HasPrefix(k, key+".") {
+			subtree[strings.TrimPrefix(k, key+".")] = value
+			markUsed(k)
+		}
+	}
+
+	if len(subtree) == 0 {
+		return "", fmt.Errorf("key %s not found", key)
+	}
+
+	tree, err := buildTree(subtree)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := json.Marshal(tree)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode key %s as JSON: %w", key, err)
+	}
+
+	return string(data), nil
+}
+
+// AsNestedMap returns the configuration as a tree of nested maps rebuilt from the dotted keys.
+// Leaf values that parse cleanly as a bool, an integer or a float are converted, arrays written
+// as literals become []interface{}, as do objects whose keys are exactly 0, 1, 2, ... such as JSON arrays.
+// Everything else stays a string. Keys are lowercased and without the prefix. It fails if a
+// key is used both as a scalar and as an object
+func AsNestedMap() (map[string]interface{}, error) {
+	tree, err := buildTree(snapshotVariables())
+	if err != nil {
+		return nil, err
+	}
+
+	arrays := snapshotArrays()
+	for key, child := range tree {
+		tree[key] = typedNode(child, key, arrays)
+	}
+	return tree, nil
+}
+
+// typedNode converts the string leaves of a tree built by buildTree to typed values. path is the
+// key of node, and arrays holds the keys whose values are arrays
+func typedNode(node interface{}, path string, arrays map[string]bool) interface{} {
+	switch node := node.(type) {
+	case map[string]interface{}:
+		for key, child := range node {
+			node[key] = typedNode(child, path+"."+key, arrays)
+		}
+
+		// Objects keyed 0..n-1 are arrays flattened into indexed keys
+		elements := make([]interface{}, len(node))
+		for i := range elements {
+			child, exists := node[strconv.Itoa(i)]
+			if !exists {
+				return node
+			}
+			elements[i] = child
+		}
+		if len(elements) > 0 {
+			return elements
+		}
+		return node
+
+	case string:
+		if elements, isArray := parseArray(node); isArray && arrays[path] {
+			typed := make([]interface{}, len(elements))
+			for i, element := range elements {
+				typed[i] = typedScalar(element)
+			}
+			return typed
+		}
+		return typedScalar(node)
+	}
+
+	return node
+}
+
+// typedScalar converts value to a bool, int64 or float64 if it parses cleanly as one
+func typedScalar(value string) interface{} {
+	if value == "true" || value == "false" {
+		return value == "true"
+	}
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return n
+	}
+	if f, err := strconv.ParseFloat(value, 64); err == nil && numberPattern.MatchString(value) {
+		return f
+	}
+	return value
+}
+
+// snapshotKey returns the snapshot key or subtree key for key, stripping the prefix only if the
+// key isn't found with it
+func snapshotKey(snapshot map[string]string, key string) string {
+	key = strings.ToLower(key)
+
+	mutex.RLock()
+	stripped := stripPrefix(key)
+	mutex.RUnlock()
+
+	if stripped == key {
+		return key
+	}
+
+	for k := range snapshot {
+		if k == key || strings.HasPrefix(k, key+".") {
+			return key
+		}
+	}
+
+	return stripped
+}
+
+// snapshotVariables returns a copy of the loaded variables keyed by their lowercased key, without the prefix
+func snapshotVariables() map[string]string {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	snapshot := make(map[string]string, len(keyIndex))
+	for lower, stored := range keyIndex {
+		snapshot[lower] = variables[stored]
+	}
+
+	return snapshot
+}
+
+// snapshotArrays returns the lowercased keys of the loaded variables whose values are arrays,
+// without the prefix like snapshotVariables
+func snapshotArrays() map[string]bool {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	arrays := make(map[string]bool)
+	for lower, stored := range keyIndex {
+		if arrayKeys[stored] {
+			arrays[lower] = true
+		}
+	}
+
+	return arrays
+}
+
+// buildTree reconstructs the object hierarchy from flat dotted keys
+func buildTree(values map[string]string) (map[string]interface{}, error) {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	root := make(map[string]interface{})
+	for _, key := range keys {
+		parts := strings.Split(key, ".")
+		node := root
+
+		for i, part := range parts[:len(parts)-1] {
+			child, exists := node[part]
+			if !exists {
+				next := make(map[string]interface{})
+				node[part] = next
+				node = next
+				continue
+			}
+
+			next, ok := child.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("key %s conflicts with scalar value at %s", key, strings.Join(parts[:i+1], "."))
+			}
+			node = next
+		}
+
+		leaf := parts[len(parts)-1]
+		if _, exists := node[leaf]; exists {
+			return nil, fmt.Errorf("key %s conflicts with an object of the same name", key)
+		}
+		node[leaf] = values[key]
+	}
+
+	return root, nil
+}
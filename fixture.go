@@ -0,0 +1,152 @@
+package hoconenv
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"sort"
+	"time"
+)
+
+// savedStateVersion is the format version written by SaveState
+const savedStateVersion = 1
+
+// savedState is the file format of SaveState
+type savedState struct {
+	Version       int                          `json:"version"`
+	Prefix        string                       `json:"prefix,omitempty"`
+	KeyCasePolicy KeyCasePolicy                `json:"keyCasePolicy"`
+	ArrayEnvStyle ArrayEnvStyle                `json:"arrayEnvStyle"`
+	Variables     map[string]string            `json:"variables"`
+	Arrays        []string                     `json:"arrays,omitempty"`
+	Origins       map[string]string            `json:"origins,omitempty"`
+	Annotations   map[string]map[string]string `json:"annotations,omitempty"`
+	Secrets       []string                     `json:"secrets,omitempty"`
+	EnvNames      map[string]string            `json:"envNames,omitempty"`
+	Files         []string                     `json:"files,omitempty"`
+	LastModified  time.Time                    `json:"lastModified"`
+}
+
+// SaveState writes the loaded configuration and the options that decide how it is applied, the
+// prefix, key case policy and array style, to path as JSON. RestoreState loads it back without
+// reading the original files or URLs, which makes it a fixture for tests. Secret values are
+// written in plain text, so the file is created with 0600 permissions
+func SaveState(path string) error {
+	mutex.RLock()
+	state := savedState{
+		Version:       savedStateVersion,
+		Prefix:        prefix,
+		KeyCasePolicy: keyCasePolicy,
+		ArrayEnvStyle: arrayEnvStyle,
+		Variables:     maps.Clone(variables),
+		Origins:       maps.Clone(origins),
+		Annotations:   maps.Clone(annotations),
+		EnvNames:      maps.Clone(envNames),
+		LastModified:  lastModified,
+	}
+	for key := range arrayKeys {
+		state.Arrays = append(state.Arrays, key)
+	}
+	for key := range secrets {
+		state.Secrets = append(state.Secrets, key)
+	}
+	for file := range loadedFiles {
+		state.Files = append(state.Files, file)
+	}
+	mutex.RUnlock()
+
+	sort.Strings(state.Arrays)
+	sort.Strings(state.Secrets)
+	sort.Strings(state.Files)
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %w", err)
+	}
+
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write state file %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// RestoreState replaces the loaded configuration with one saved by SaveState and applies it to
+// the environment like a load. The saved prefix, key case policy and array style replace the
+// current ones. If the state can't be read or applied, nothing changes
+func RestoreState(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read state file %s: %w", path, err)
+	}
+
+	var state savedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("failed to decode state file %s: %w", path, err)
+	}
+	if state.Version != savedStateVersion {
+		return fmt.Errorf("unsupported state file version %d in %s", state.Version, path)
+	}
+
+	loadMutex.Lock()
+	defer loadMutex.Unlock()
+
+	mutex.Lock()
+	if err := checkFrozen("restore state"); err != nil {
+		mutex.Unlock()
+		return err
+	}
+
+	saved := captureState()
+	previousPrefix, previousPolicy, previousStyle := prefix, keyCasePolicy, arrayEnvStyle
+
+	prefix, keyCasePolicy, arrayEnvStyle = state.Prefix, state.KeyCasePolicy, state.ArrayEnvStyle
+	restoreState(&loadState{
+		variables:         make(map[string]string),
+		keyIndex:          make(map[string]string),
+		arrayKeys:         make(map[string]bool),
+		loadedFiles:       make(map[string]bool),
+		reloadableFiles:   make(map[string]bool),
+		loadOrder:         make(map[string]int),
+		includeGraph:      make(map[string][]string),
+		defaults:          make(map[string]rawValue),
+		pendingValues:     make(map[string]rawValue),
+		overriddenPending: make(map[string][]rawValue),
+		unresolved:        make(map[string][]string),
+		origins:           make(map[string]string),
+		history:           make(map[string][]historyEntry),
+		annotations:       make(map[string]map[string]string),
+		secrets:           make(map[string]bool),
+		envNames:          make(map[string]string),
+		lastModified:      state.LastModified,
+	})
+
+	arrays := make(map[string]bool, len(state.Arrays))
+	for _, key := range state.Arrays {
+		arrays[key] = true
+	}
+	for key, value := range state.Variables {
+		storeValue(key, value, arrays[key])
+	}
+	maps.Copy(origins, state.Origins)
+	maps.Copy(annotations, state.Annotations)
+	maps.Copy(envNames, state.EnvNames)
+	for _, key := range state.Secrets {
+		secrets[key] = true
+	}
+	for _, file := range state.Files {
+		markLoaded(file)
+	}
+	mutex.Unlock()
+
+	if err := applyVariables(); err != nil {
+		mutex.Lock()
+		restoreState(saved)
+		prefix, keyCasePolicy, arrayEnvStyle = previousPrefix, previousPolicy, previousStyle
+		mutex.Unlock()
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,218 @@
+package hoconenv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// loadJSONFile parses a JSON file and flattens it into dotted keys, with array
+// elements addressed by index (servers.0.host, servers.1.host, ...)
+func loadJSONFile(filePath string) error {
+	mutex.Lock()
+	if loadedFiles[filePath] {
+		mutex.Unlock()
+		return nil // Skip already loaded files
+	}
+	markLoaded(filePath)
+	mutex.Unlock()
+
+	data, err := readConfigFile(filePath)
+	if err != nil {
+		forgetFile(filePath)
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%w: %s", ErrFileNotFound, filePath)
+		}
+
+		return fmt.Errorf("failed to open config file %s: %w", filePath, err)
+	}
+
+	decoder := json.NewDecoder(decodeReader(bytes.NewReader(data), configuredEncoding()))
+	decoder.UseNumber()
+
+	var root interface{}
+	if err := decoder.Decode(&root); err != nil {
+		return markError(ErrSyntax, fmt.Errorf("invalid JSON in %s: %w", filePath, err))
+	}
+
+	if _, ok := root.(map[string]interface{}); !ok {
+		return markError(ErrSyntax, fmt.Errorf("invalid JSON in %s: top-level value must be an object", filePath))
+	}
+
+	state := newParseState()
+	if err := flattenJSON("", root, state, filePath); err != nil {
+		return fmt.Errorf("%w in %s", err, filePath)
+	}
+	state.flush()
+
+	return nil
+}
+
+// flattenJSON stores every scalar in value under its dotted path
+func flattenJSON(path string, value interface{}, state *parseState, filePath string) error {
+	join := func(key string) string {
+		if path == "" {
+			return key
+		}
+		return path + "." + key
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if err := flattenJSON(join(key), child, state, filePath); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for i, child := range v {
+			if err := flattenJSON(join(strconv.Itoa(i)), child, state, filePath); err != nil {
+				return err
+			}
+		}
+	case nil:
+		// A null leaves the key unset
+	default:
+		return state.set(path, fmt.Sprint(v), filePath, false)
+	}
+
+	return nil
+}
+
+// loadPropertiesFile parses a Java-style .properties file. Keys and values are separated by
+// "=", ":" or whitespace, lines starting with "#" or "!" are comments, a trailing backslash
+// continues the line and escapes such as \t, \n and \uXXXX are decoded. Quotes are kept as-is
+func loadPropertiesFile(filePath string) error {
+	mutex.Lock()
+	if loadedFiles[filePath] {
+		mutex.Unlock()
+		return nil // Skip already loaded files
+	}
+	markLoaded(filePath)
+	mutex.Unlock()
+
+	file, err := openConfigFile(filePath)
+	if err != nil {
+		forgetFile(filePath)
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%w: %s", ErrFileNotFound, filePath)
+		}
+
+		return fmt.Errorf("failed to open config file %s: %w", filePath, err)
+	}
+
+	defer file.Close()
+
+	scanner := bufio.NewScanner(decodeReader(file, configuredEncoding()))
+	state := newParseState()
+	defer state.flush()
+	logical := ""
+	lineNum, startLine := 0, 0
+
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimLeft(scanner.Text(), " \t\f")
+
+		if logical == "" {
+			if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "!") {
+				continue
+			}
+			startLine = lineNum
+		}
+
+		// An odd number of trailing backslashes continues the logical line
+		trailing := len(line) - len(strings.TrimRight(line, "\\"))
+		if trailing%2 == 1 {
+			logical += line[:len(line)-1]
+			continue
+		}
+
+		logical += line
+		key, value := splitProperty(logical)
+		logical = ""
+
+		if err := state.set(key, value, location(filePath, startLine), false); err != nil {
+			return fmt.Errorf("%w at %s:%d", err, filePath, startLine)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading file %s: %w", filePath, err)
+	}
+
+	if logical != "" {
+		key, value := splitProperty(logical)
+		if err := state.set(key, value, location(filePath, startLine), false); err != nil {
+			return fmt.Errorf("%w at %s:%d", err, filePath, startLine)
+		}
+	}
+
+	return nil
+}
+
+// splitProperty splits a logical properties line into its unescaped key and value
+func splitProperty(line string) (string, string) {
+	end := len(line)
+	for i := 0; i < len(line); i++ {
+		if line[i] == '\\' {
+			i++ // Skip the escaped character
+			continue
+		}
+		if line[i] == '=' || line[i] == ':' || line[i] == ' ' || line[i] == '\t' || line[i] == '\f' {
+			end = i
+			break
+		}
+	}
+
+	key := line[:end]
+	rest := strings.TrimLeft(line[end:], " \t\f")
+	if strings.HasPrefix(rest, "=") || strings.HasPrefix(rest, ":") {
+		rest = strings.TrimLeft(rest[1:], " \t\f")
+	}
+
+	return unescapeProperty(key), unescapeProperty(rest)
+}
+
+// unescapeProperty decodes the escape sequences allowed in properties files
+func unescapeProperty(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i == len(s)-1 {
+			b.WriteByte(s[i])
+			continue
+		}
+
+		i++
+		switch s[i] {
+		case 't':
+			b.WriteByte('\t')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 'f':
+			b.WriteByte('\f')
+		case 'u':
+			if i+4 < len(s) {
+				if r, err := strconv.ParseUint(s[i+1:i+5], 16, 32); err == nil {
+					b.WriteRune(rune(r))
+					i += 4
+					continue
+				}
+			}
+			b.WriteByte('u')
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+
+	return b.String()
+}
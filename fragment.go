@@ -0,0 +1,82 @@
+package hoconenv
+
+import "strings"
+
+var (
+	// activeFragments holds the fragments selected for the load in progress, or nil outside a fragment load
+	activeFragments map[string]bool
+
+	// fragmentInclude is set while loading a file included from inside a selected fragment
+	fragmentInclude = false
+)
+
+// LoadFragment loads only the contents of the fragment "name" { ... } blocks in files
+func LoadFragment(name string, files ...string) error {
+	return LoadFragments([]string{name}, files...)
+}
+
+// LoadFragments loads only the contents of the fragment blocks named in names. Keys outside
+// any fragment are skipped, as are fragments that weren't selected. Fragment names don't
+// become part of the keys, and a plain Load skips every fragment block
+func LoadFragments(names []string, files ...string) error {
+	selected := make(map[string]bool, len(names))
+	for _, name := range names {
+		selected[name] = true
+	}
+
+	return load(loadOptions{fragments: selected}, files...)
+}
+
+// fragmentName returns the fragment name if blockKey opens a fragment block
+func fragmentName(blockKey string) (string, bool) {
+	if !strings.HasPrefix(blockKey, "fragment ") {
+		return "", false
+	}
+
+	return strings.Trim(strings.TrimSpace(strings.TrimPrefix(blockKey, "fragment")), "\"'"), true
+}
+
+// skipFragment reports whether the current position is inside a fragment that isn't selected,
+// or outside every selected fragment during a fragment load
+func skipFragment(state *parseState) bool {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	inSelected := state.inFragment
+	for _, blockKey := range state.keyStack {
+		if name, ok := fragmentName(blockKey); ok {
+			if !activeFragments[name] {
+				return true
+			}
+			inSelected = true
+		}
+	}
+
+	return activeFragments != nil && !inSelected
+}
+
+// insideFragment reports whether the current position is inside a fragment, which skipFragment
+// has already checked is selected
+func (s *parseState) insideFragment() bool {
+	if s.inFragment {
+		return true
+	}
+
+	for _, blockKey := range s.keyStack {
+		if _, ok := fragmentName(blockKey); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// swapFragmentInclude sets whether included files are inside a selected fragment and returns the previous setting
+func swapFragmentInclude(inside bool) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	previous := fragmentInclude
+	fragmentInclude = inside
+	return previous
+}
@@ -0,0 +1,33 @@
+package hoconenv
+
+import "fmt"
+
+// frozen makes operations that modify the configuration fail, once Freeze is called
+var frozen bool
+
+// Freeze locks the configuration, for services that should only be configured once at
+// startup. Afterwards Load, LoadReader, ReloadFile, RestoreState and ImportEnv fail with
+// ErrFrozen, and SetPrefix is ignored with a warning. Lazy loaders registered with RegisterLazy
+// that haven't run yet load too, so they fail with a warning when their section is first read.
+// Reads and Override keep working. Only Reset unfreezes the configuration
+func Freeze() {
+	mutex.Lock()
+	defer mutex.Unlock()
+	frozen = true
+}
+
+// Frozen reports whether Freeze has been called since the last Reset
+func Frozen() bool {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return frozen
+}
+
+// checkFrozen returns an error naming operation if the configuration is frozen. The caller
+// must hold the mutex
+func checkFrozen(operation string) error {
+	if frozen {
+		return fmt.Errorf("%w: cannot %s", ErrFrozen, operation)
+	}
+	return nil
+}
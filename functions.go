@@ -0,0 +1,114 @@
+package hoconenv
+
+import (
+	"crypto/rand"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// functionPattern matches a function call inside a substitution, e.g. date("2006-01-02")
+var functionPattern = regexp.MustCompile(`^([A-Za-z_]\w*)\((.*)\)$`)
+
+// substitutionFunctions are the built-in functions usable as ${name(args)}. Each returns false
+// if it has no value, which is treated like an undefined path
+var substitutionFunctions = map[string]struct {
+	arity int
+	call  func(args []string) (string, bool)
+}{
+	"date": {1, func(args []string) (string, bool) {
+		return time.Now().Format(args[0]), true
+	}},
+	"env": {1, func(args []string) (string, bool) {
+		return os.LookupEnv(args[0])
+	}},
+	"uuid": {0, func(args []string) (string, bool) {
+		return newUUID(), true
+	}},
+}
+
+// parseFunctionCall splits a substitution path into a function name and its quoted arguments
+func parseFunctionCall(path string) (string, []string, bool, error) {
+	match := functionPattern.FindStringSubmatch(path)
+	if match == nil {
+		return "", nil, false, nil
+	}
+
+	var args []string
+	for _, arg := range splitCandidates(match[2]) {
+		if len(arg) < 2 || (arg[0] != '"' && arg[0] != '\'') || arg[len(arg)-1] != arg[0] {
+			return "", nil, true, fmt.Errorf("argument %s of %s() must be a quoted string", arg, match[1])
+		}
+		args = append(args, arg[1:len(arg)-1])
+	}
+
+	return match[1], args, true, nil
+}
+
+// checkFunctions reports unknown functions or wrong argument counts in the substitutions of value
+func checkFunctions(value string) error {
+	for _, path := range substitutionPaths(value) {
+		name, args, isCall, err := parseFunctionCall(path)
+		if err != nil {
+			return err
+		}
+		if !isCall {
+			continue
+		}
+
+		fn, exists := substitutionFunctions[name]
+		if !exists {
+			return fmt.Errorf("unknown function %s()", name)
+		}
+		if len(args) != fn.arity {
+			return fmt.Errorf("function %s() takes %d argument(s), got %d", name, fn.arity, len(args))
+		}
+	}
+
+	return nil
+}
+
+// callFunction evaluates a function call substitution, returning false if it has no value
+func callFunction(name string, args []string) (string, bool) {
+	fn, exists := substitutionFunctions[name]
+	if !exists || len(args) != fn.arity {
+		return "", false
+	}
+	return fn.call(args)
+}
+
+// substitutionPaths returns the paths of the ${...} substitutions in value outside of quotes
+func substitutionPaths(value string) []string {
+	var paths []string
+	for i := 0; i < len(value); i++ {
+		switch {
+		case value[i] == '"':
+			end := strings.IndexByte(value[i+1:], '"')
+			if end == -1 {
+				return paths
+			}
+			i += end + 1
+		case strings.HasPrefix(value[i:], "$${"):
+			i += 2
+		case strings.HasPrefix(value[i:], "${"):
+			end := strings.IndexByte(value[i:], '}')
+			if end == -1 {
+				return paths
+			}
+			paths = append(paths, strings.TrimSpace(strings.TrimPrefix(value[i+2:i+end], "?")))
+			i += end
+		}
+	}
+	return paths
+}
+
+// newUUID returns a random version 4 UUID
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,241 @@
+package hoconenv
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GetIndex returns element i of the array stored under key. Arrays can be written as a
+// literal ("[a, b, c]") or come from indexed keys such as those produced by JSON includes
+// (key.0, key.1, ...). It returns false if key is not an array or i is out of range
+func GetIndex(key string, i int) (string, bool) {
+	if i < 0 {
+		return "", false
+	}
+
+	if value, ok := lookupValue(key); ok {
+		elements, isArray := parseArray(value)
+		if !isArray || !isArrayKey(key) || i >= len(elements) {
+			return "", false
+		}
+		return elements[i], true
+	}
+
+	return lookupValue(key + "." + strconv.Itoa(i))
+}
+
+// GetLen returns the number of elements in the array stored under key, or 0 if it is not an array
+func GetLen(key string) int {
+	if value, ok := lookupValue(key); ok {
+		if !isArrayKey(key) {
+			return 0
+		}
+		elements, _ := parseArray(value)
+		return len(elements)
+	}
+
+	n := 0
+	for {
+		if _, ok := lookupValue(key + "." + strconv.Itoa(n)); !ok {
+			return n
+		}
+		n++
+	}
+}
+
+// isArrayLiteral reports whether a raw value as written in a file is an unquoted array literal
+func isArrayLiteral(raw string) bool {
+	_, isArray := parseArray(stripInlineComment(raw))
+	return isArray
+}
+
+// isArrayKey reports whether the value stored for key was written as an array
+func isArrayKey(key string) bool {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return isArrayValue(key)
+}
+
+// isArrayValue is isArrayKey for callers that hold the mutex
+func isArrayValue(key string) bool {
+	stored, exists := canonicalKey(key)
+	return exists && arrayKeys[stored]
+}
+
+// parseArray splits an array literal into its elements, unquoting quoted elements.
+// Commas inside quotes or nested brackets don't separate elements
+func parseArray(value string) ([]string, bool) {
+	value = strings.TrimSpace(value)
+	if len(value) < 2 || value[0] != '[' || value[len(value)-1] != ']' {
+		return nil, false
+	}
+
+	inner := strings.TrimSpace(value[1 : len(value)-1])
+	if inner == "" {
+		return []string{}, true
+	}
+
+	var elements []string
+	var quote byte
+	depth, start := 0, 0
+	for i := 0; i < len(inner); i++ {
+		c := inner[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[' || c == '{':
+			depth++
+		case c == ']' || c == '}':
+			depth--
+		case c == ',' && depth == 0:
+			elements = append(elements, unquoteElement(inner[start:i]))
+			start = i + 1
+		}
+	}
+
+	// A trailing comma doesn't add an empty element
+	if last := strings.TrimSpace(inner[start:]); last != "" {
+		elements = append(elements, unquoteElement(last))
+	}
+
+	return elements, true
+}
+
+// elementUnescaper reverses elementEscaper
+var elementUnescaper = strings.NewReplacer("\\\\", "\\", "\\\"", "\"")
+
+// unquoteElement trims an array element and removes matching surrounding quotes. Escaped
+// backslashes and quotes inside double quotes are unescaped
+func unquoteElement(element string) string {
+	element = strings.TrimSpace(element)
+	if len(element) >= 2 && element[0] == '"' && element[len(element)-1] == '"' {
+		return elementUnescaper.Replace(element[1 : len(element)-1])
+	}
+	if len(element) >= 2 && element[0] == '\'' && element[len(element)-1] == '\'' {
+		return element[1 : len(element)-1]
+	}
+	return element
+}
+
+// GetStringMapString returns the immediate children of the object at key as a map from their
+// names, as written, to their values, e.g. the headers in headers { "X-Api-Key" = abc }.
+// Nested objects below the children are left out. It returns an empty map if key has no children
+func GetStringMapString(key string) map[string]string {
+	return childValues(key, false)
+}
+
+// childValues returns the values below key by their path relative to key, as written. Keys
+// more than one level below key are only included if nested is set
+func childValues(key string, nested bool) map[string]string {
+	runLazyLoaders(key)
+
+	parent := strings.ToLower(stripPrefix(key)) + "."
+	result := make(map[string]string)
+	var used []string
+
+	mutex.RLock()
+	for stored, value := range variables {
+		if len(stored) <= len(parent) || strings.ToLower(stored[:len(parent)]) != parent {
+			continue
+		}
+
+		name := stored[len(parent):]
+		if !nested && strings.Contains(name, ".") {
+			continue
+		}
+
+		result[name] = value
+		used = append(used, strings.ToLower(stored))
+	}
+	mutex.RUnlock()
+
+	for _, stored := range used {
+		markUsed(stored)
+	}
+
+	return result
+}
+
+// GetDuration returns the duration stored under key, or defaultValue if it is missing or
+// invalid. Durations use Go syntax ("1h30m") with an additional "d" unit for days ("2d", "1d12h")
+func GetDuration(key string, defaultValue time.Duration) time.Duration {
+	if value, ok := lookupValue(key); ok {
+		if d, err := parseDuration(value); err == nil {
+			return d
+		}
+	}
+
+	return defaultValue
+}
+
+// GetDurationEnv returns the duration stored under key, falling back to the environment
+// variable envVar and then to defaultValue. Values that fail to parse are skipped
+func GetDurationEnv(key, envVar string, defaultValue time.Duration) time.Duration {
+	if value, ok := lookupValue(key); ok {
+		if d, err := parseDuration(value); err == nil {
+			return d
+		}
+	}
+
+	if value := os.Getenv(envVar); value != "" {
+		if d, err := parseDuration(value); err == nil {
+			return d
+		}
+	}
+
+	return defaultValue
+}
+
+// IsEnabled reports whether the feature flag stored under key is switched on. Only the values
+// true, yes, on, 1 and enabled count, in any case; anything else, or a missing key, is false
+func IsEnabled(key string) bool {
+	value, ok := lookupValue(key)
+	if !ok {
+		return false
+	}
+
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "true", "yes", "on", "1", "enabled":
+		return true
+	}
+	return false
+}
+
+// parseDuration parses a Go duration string that may start with a number of days
+func parseDuration(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+
+	days, rest, found := strings.Cut(value, "d")
+	if !found {
+		return time.ParseDuration(value)
+	}
+
+	n, err := strconv.ParseFloat(days, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+
+	d := time.Duration(n * float64(24*time.Hour))
+	if rest == "" {
+		return d, nil
+	}
+
+	extra, err := time.ParseDuration(rest)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+
+	if n < 0 {
+		return d - extra, nil
+	}
+	return d + extra, nil
+}
@@ -1,3 +1,5 @@
 module github.com/ezrantn/hoconenv
 
 go 1.23.5
+
+require golang.org/x/text v0.28.0
@@ -0,0 +1,100 @@
+package hoconenv
+
+import "strings"
+
+var (
+	trackHistory = false
+
+	// history holds every value each key received, keyed like origins
+	history = make(map[string][]historyEntry)
+
+	// overriddenPending holds substitutions replaced before they were resolved, which are
+	// still resolved for their history entry
+	overriddenPending = make(map[string][]rawValue)
+)
+
+// historyEntry is one value a key received. Substitutions reserve their entry when parsed
+// and fill it in once resolved, so entries stay in load order
+type historyEntry struct {
+	value    string
+	resolved bool
+}
+
+// SetTrackHistory enables recording every value assigned to each key, as reported by GetAll.
+// Tracking is off by default to avoid the overhead
+func SetTrackHistory(enabled bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	trackHistory = enabled
+}
+
+// GetAll returns every value key was assigned, in load order, including values that were later
+// overridden. It returns nil if the key is unknown or history tracking is disabled
+func GetAll(key string) []string {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	stored, exists := canonicalKey(key)
+	if !exists {
+		return nil
+	}
+
+	var values []string
+	for _, entry := range history[strings.ToLower(stored)] {
+		if entry.resolved {
+			values = append(values, entry.value)
+		}
+	}
+
+	return values
+}
+
+// recordHistory appends a value for key. The caller must hold the mutex
+func recordHistory(key, value string) {
+	if trackHistory {
+		key = strings.ToLower(key)
+		history[key] = append(history[key], historyEntry{value: value, resolved: true})
+	}
+}
+
+// reserveHistory appends an unresolved entry for a substitution and returns its index, or -1
+// if tracking is disabled. The caller must hold the mutex
+func reserveHistory(key string) int {
+	if !trackHistory {
+		return -1
+	}
+
+	key = strings.ToLower(key)
+	history[key] = append(history[key], historyEntry{})
+	return len(history[key]) - 1
+}
+
+// resolveHistory fills in an entry reserved by reserveHistory. The caller must hold the mutex
+func resolveHistory(key string, index int, value string) {
+	entries := history[strings.ToLower(key)]
+	if index >= 0 && index < len(entries) {
+		entries[index] = historyEntry{value: value, resolved: true}
+	}
+}
+
+// overridePending keeps the history entry of a pending assignment that is about to be replaced.
+// The caller must hold the mutex
+func overridePending(key string) {
+	if pending, exists := pendingValues[key]; exists && pending.history >= 0 {
+		overriddenPending[key] = append(overriddenPending[key], pending)
+	}
+}
+
+// resolveOverriddenHistory fills in the history entries of overridden substitutions once the
+// final values are known. The caller must hold the mutex
+func resolveOverriddenHistory() {
+	for key, values := range overriddenPending {
+		for _, pending := range values {
+			if resolved, _, ok := resolveSubstitutions(pending.value, pending.scope, map[string]bool{key: true}); ok {
+				resolveHistory(key, pending.history, resolved)
+			}
+		}
+	}
+
+	overriddenPending = make(map[string][]rawValue)
+}
@@ -2,194 +2,1214 @@ package hoconenv
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// sniffLen is how many leading bytes are inspected to detect binary input
+const sniffLen = 512
+
 var (
-	variables   = make(map[string]string)
-	loadedFiles = make(map[string]bool)
-	mutex       sync.RWMutex
-	prefix      = ""
+	variables    = make(map[string]string) // Values by key as written in the config
+	keyIndex     = make(map[string]string) // Lowercased key to the key in variables supplying its value
+	arrayKeys    = make(map[string]bool)   // Keys in variables whose value was written as an array
+	loadedFiles  = make(map[string]bool)
+	parsingFiles = make(map[string]bool) // Files currently being parsed, to catch include always cycles
+	includeGraph = make(map[string][]string)
+	defaults     = make(map[string]rawValue)
+	mutex        sync.RWMutex
+	prefix       = ""
+	loader       = &onceLoader{}
+	keyFilter    func(key string) bool // Key filter of the load in progress, set by atomicLoadWith
+
+	defaultPatterns = []string{"application.*"}
+	configNameEnv   = "CONFIG_NAME"
+	patternsSet     = false // Whether SetDefaultFilePattern was called, which takes precedence over configNameEnv
+	discoveryWalkUp = false
+	errorOnNoFiles  = false
+	maxKeys         = 0
+
+	// openedFiles counts the config files opened so far, to tell whether a load read any
+	openedFiles atomic.Int64
+
+	numberPattern = regexp.MustCompile(`^([+-]?)(\d+(?:_\d+)*)?(\.\d+(?:_\d+)*)?$`)
 )
 
-// SetPrefix configures the global prefix for environment variables
+// onceLoader remembers the outcome of the first LoadOnce call
+type onceLoader struct {
+	once sync.Once
+	err  error
+}
+
+// SetPrefix configures the global prefix for environment variables. A trailing "." is optional
+// and an empty prefix disables prefixing. After Freeze the prefix is kept and a warning is recorded
 func SetPrefix(p string) {
 	mutex.Lock()
 	defer mutex.Unlock()
-	prefix = strings.ToLower(strings.TrimSpace(p)) + "."
+
+	if err := checkFrozen("change the prefix"); err != nil {
+		recordWarning("%v", err)
+		return
+	}
+
+	p = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(p)), ".")
+	if p == "" {
+		prefix = ""
+		return
+	}
+	prefix = p + "."
+}
+
+// StripPrefix returns key without the configured prefix, or key unchanged if it doesn't carry it
+func StripPrefix(key string) string {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return stripPrefix(key)
 }
 
-// Load loads configuration from specified files or default application.* files
+// stripPrefix removes the prefix from key, ignoring case. The caller must hold the mutex
+func stripPrefix(key string) string {
+	if prefix != "" && len(key) > len(prefix) && strings.EqualFold(key[:len(prefix)], prefix) {
+		return key[len(prefix):]
+	}
+	return key
+}
+
+// Load loads configuration from specified files or default application.* files, or the files
+// named by the CONFIG_NAME environment variable (see SetConfigNameEnv) unless the patterns were
+// set with SetDefaultFilePattern
 func Load(files ...string) error {
+	return load(loadOptions{}, files...)
+}
+
+// load loads files like Load with the options of a single load, such as the filter of LoadFiltered
+func load(opts loadOptions, files ...string) error {
 	// If no fileName is passed, search for default files
 	if len(files) == 0 {
-		matches, err := filepath.Glob("application.*")
-		if err == nil && len(matches) > 0 {
-			for _, match := range matches {
-				if err := loadFile(match); err != nil {
-					return err
-				}
+		mutex.RLock()
+		patterns := defaultPatterns
+		nameEnv := configNameEnv
+		explicit := patternsSet
+		walkUp := discoveryWalkUp
+		mutex.RUnlock()
+
+		if len(patterns) == 0 {
+			return fmt.Errorf("default configuration loading is disabled, pass files to Load explicitly")
+		}
+
+		// The config name variable lets deployments pick the base file name without code changes,
+		// unless the program chose the patterns itself
+		if name := os.Getenv(nameEnv); !explicit && nameEnv != "" && name != "" {
+			patterns = []string{name + ".*"}
+		}
+
+		matches, err := findDefaultFiles(patterns, walkUp)
+		if err != nil {
+			return err
+		}
+
+		if len(matches) == 0 {
+			return fmt.Errorf("no default configuration files found")
+		}
+		files = matches
+	}
+
+	// Parse all specified files; if any fails, nothing from this load is kept
+	return atomicLoadWith(opts, func() error {
+		before := openedFiles.Load()
+		for _, file := range files {
+			mutex.RLock()
+			direct := !loadedFiles[file]
+			mutex.RUnlock()
+
+			if err := loadByExtension(file); err != nil {
+				return err
+			}
+
+			if direct {
+				markReloadable(file)
 			}
+		}
+
+		mutex.RLock()
+		requireFiles := errorOnNoFiles
+		mutex.RUnlock()
+
+		if requireFiles && openedFiles.Load() == before {
+			return fmt.Errorf("no configuration files were loaded from %s", strings.Join(files, ", "))
+		}
+		return nil
+	})
+}
+
+// LoadDir loads the config files directly in dir, such as a drop-in /etc/app/conf.d, in the
+// same name order as an include directory(...). Only files with a .conf, .hocon, .json or
+// .properties extension are loaded, each with the parser for its extension
+func LoadDir(dir string) error {
+	return loadDir(dir, false)
+}
+
+// LoadDirRecursive loads the config files in dir like LoadDir, including those in its
+// subdirectories. Each subdirectory is loaded in its place in the name order
+func LoadDirRecursive(dir string) error {
+	return loadDir(dir, true)
+}
+
+// loadDir loads the config files found in dir
+func loadDir(dir string, recursive bool) error {
+	configFiles, err := listConfigFiles(dir, recursive)
+	if err != nil {
+		return fmt.Errorf("failed to read directory %s: %w", dir, err)
+	}
+
+	if len(configFiles) == 0 {
+		return fmt.Errorf("no configuration files found in directory %s", dir)
+	}
+
+	return Load(configFiles...)
+}
+
+// SetMaxKeys makes Load fail once the configuration would hold more than n distinct keys, as a
+// guard against runaway generated configs or globs. Zero, the default, means unlimited
+func SetMaxKeys(n int) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	maxKeys = n
+}
+
+// checkMaxKeys returns an error if assigning fullKey would exceed the key limit
+func (s *parseState) checkMaxKeys(fullKey string) error {
+	mutex.RLock()
+	limit := maxKeys
+	mutex.RUnlock()
+
+	if limit <= 0 {
+		return nil
+	}
+
+	// Batched keys aren't in the store yet, so they are stored first to count them
+	s.flush()
+
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	count := len(keyIndex)
+	for key := range pendingValues {
+		if _, exists := keyIndex[strings.ToLower(key)]; !exists {
+			count++
+		}
+	}
+
+	_, exists := keyIndex[strings.ToLower(fullKey)]
+	if _, isPending := pendingValues[fullKey]; exists || isPending || count < limit {
+		return nil
+	}
+
+	return fmt.Errorf("config exceeds the maximum of %d keys with %s", limit, fullKey)
+}
+
+// SetErrorOnNoFiles makes Load fail when it ends up reading no file at all, for example because
+// every file was already loaded, which catches config that was never mounted. It is disabled
+// by default, so such a load succeeds without changes
+func SetErrorOnNoFiles(enabled bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	errorOnNoFiles = enabled
+}
+
+// LoadReader loads HOCON configuration from r like Load does for a file. The name is used in
+// error messages, as the origin of its keys and as the base for relative includes
+func LoadReader(r io.Reader, name string) error {
+	return atomicLoad(func() error {
+		mutex.Lock()
+		if loadedFiles[name] {
+			mutex.Unlock()
 			return nil
 		}
-		return fmt.Errorf("no default configuration files found")
+		markLoaded(name)
+		mutex.Unlock()
+
+		return parseReader(decodeReader(r, configuredEncoding()), name)
+	})
+}
+
+// beginLoad resets the state that only applies to a single load
+func beginLoad() {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	// Include priorities only decide between values from the same load
+	keyPriority = make(map[string]int)
+	warnings = nil
+}
+
+// finishLoad resolves everything parsed during a load and applies it to the environment
+func finishLoad() error {
+	// Defaults only fill in keys that no file assigned
+	applyDefaults()
+
+	// Substitutions are resolved once everything is parsed, so forward references work
+	resolvePending()
+
+	// Templates are rendered after substitution, against the data passed to LoadWithData
+	if err := renderTemplates(); err != nil {
+		return err
 	}
 
-	// Load all specified files
-	for _, file := range files {
-		if err := loadFile(file); err != nil {
-			return err
+	checkEnvCollisions()
+
+	if err := checkEnvNames(); err != nil {
+		return err
+	}
+
+	if err := warningsError(); err != nil {
+		return err
+	}
+
+	// Apply variables to environment
+	return applyVariables()
+}
+
+// SetDefaultFilePattern configures the glob patterns searched when Load is called without files.
+// Calling it with no patterns disables default loading entirely. Patterns set here take
+// precedence over the CONFIG_NAME environment variable
+func SetDefaultFilePattern(patterns ...string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	defaultPatterns = append([]string(nil), patterns...)
+	patternsSet = true
+}
+
+// SetConfigNameEnv sets the environment variable that picks the base file name when Load is
+// called without files, CONFIG_NAME by default. If it is set to e.g. "service", Load searches
+// service.* instead of the default patterns, unless they were set with SetDefaultFilePattern.
+// An empty name turns the lookup off
+func SetConfigNameEnv(name string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	configNameEnv = name
+}
+
+// SetDiscoveryWalkUp makes Load without files search the parent directories of the working
+// directory when no default file is found in it, stopping at the first directory with a match
+// or at the filesystem root. It is disabled by default
+func SetDiscoveryWalkUp(enabled bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	discoveryWalkUp = enabled
+}
+
+// findDefaultFiles returns the files matching the default patterns in the working directory,
+// or with walkUp in the nearest parent directory that has any
+func findDefaultFiles(patterns []string, walkUp bool) ([]string, error) {
+	dir := ""
+	for {
+		var matches []string
+		for _, pattern := range patterns {
+			found, err := filepath.Glob(filepath.Join(dir, pattern))
+			if err != nil {
+				return nil, fmt.Errorf("invalid default file pattern %s: %w", pattern, err)
+			}
+			matches = append(matches, found...)
+		}
+
+		if len(matches) > 0 || !walkUp {
+			return matches, nil
 		}
+
+		if dir == "" {
+			cwd, err := os.Getwd()
+			if err != nil {
+				return nil, fmt.Errorf("failed to get working directory: %w", err)
+			}
+			dir = cwd
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil, nil
+		}
+		dir = parent
 	}
+}
+
+// LoadOnce loads configuration exactly once per process, no matter how many times it is called.
+// Subsequent calls return the error from the first call; Reset allows loading again
+func LoadOnce(files ...string) error {
+	mutex.RLock()
+	l := loader
+	mutex.RUnlock()
+
+	l.once.Do(func() {
+		l.err = Load(files...)
+	})
+
+	return l.err
+}
+
+// Reset clears all loaded configuration and pending lazy loaders, and restores every option,
+// including the prefix and the LoadOnce state, to its default. Environment variables that
+// were already set are left untouched
+func Reset() {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	variables = make(map[string]string)
+	keyIndex = make(map[string]string)
+	arrayKeys = make(map[string]bool)
+	loadedFiles = make(map[string]bool)
+	reloadableFiles = make(map[string]bool)
+	loadOrder = make(map[string]int)
+	parsingFiles = make(map[string]bool)
+	includeGraph = make(map[string][]string)
+	defaults = make(map[string]rawValue)
+	pendingValues = make(map[string]rawValue)
+	unresolved = make(map[string][]string)
+	keyPriority = make(map[string]int)
+	includePriority = defaultPriority
+	requireNonEmptyIncludes = false
+	includeTimeout = 0
+	origins = make(map[string]string)
+	trackOrigins = false
+	parseAnnotations = false
+	annotations = make(map[string]map[string]string)
+	envNames = make(map[string]string)
+	lastModified = time.Time{}
+	trackUsage = false
+	usage = make(map[string]bool)
+	warnings = nil
+	warningsAsErrors = false
+	history = make(map[string][]historyEntry)
+	overriddenPending = make(map[string][]rawValue)
+	trackHistory = false
+	secrets = make(map[string]bool)
+	lazyLoaders = make(map[string]func() error)
+	directives = make(map[string]DirectiveFunc)
+	decoders = builtinDecoders()
+	prefix = ""
+	activeProfile = ""
+	activeFragments = nil
+	fragmentInclude = false
+	templateData = nil
+	keyFilter = nil
+	defaultPatterns = []string{"application.*"}
+	configNameEnv = "CONFIG_NAME"
+	patternsSet = false
+	discoveryWalkUp = false
+	errorOnNoFiles = false
+	maxKeys = 0
+	allowExec = false
+	frozen = false
+	commentPrefixes = []string{"#", "//"}
+	includeCacheDir = ""
+	keyCasePolicy = KeyCaseLowerAll
+	arrayEnvStyle = ArrayEnvJoined
+	strictEnvNames = false
+	envFallback = false
+	envNameSanitizer = nil
+	useCacheOnFailure = false
+	standardSearchPaths = nil
+	fileEncoding = nil
+	includeFS = nil
+	globBase = GlobBaseFile
+	includeSort = IncludeSortLexical
+	includeHosts = nil
+	blockPrivateIncludes = false
+	loader = &onceLoader{}
+}
+
+// Close releases resources held by the package: idle HTTP connections used by URL includes
+// and lazy loaders that never ran. Loaded configuration remains available
+func Close() error {
+	httpClient.CloseIdleConnections()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	lazyLoaders = make(map[string]func() error)
 
 	return nil
 }
 
+// LoadFiltered loads configuration like Load but only stores and applies keys for which filter
+// returns true. The filter receives the full dotted key before the prefix is added
+func LoadFiltered(filter func(key string) bool, files ...string) error {
+	return load(loadOptions{filter: filter}, files...)
+}
+
 // GetDefaultValue retrieves the environment variable by key
 func GetDefaultValue(key, defaultValue string) string {
+	if value, ok := lookupValue(key); ok {
+		return value
+	}
+
+	return defaultValue
+}
+
+// lookupValue returns the non-empty value stored for key. The key may be given with or without
+// the prefix; a config key that itself starts with the prefix string is preferred over stripping it
+func lookupValue(key string) (string, bool) {
+	runLazyLoaders(key)
+
+	mutex.RLock()
+	found, value, exists := findVariable(key)
+	tracking := trackUsage
+	name := ""
+	if envFallback && !exists {
+		name = envName(stripPrefix(key))
+	}
+	mutex.RUnlock()
+
+	if exists && tracking {
+		markUsed(found)
+	}
+
+	// Keys missing from the configuration can be read from the environment they would be applied to
+	if name != "" {
+		value, exists = os.LookupEnv(name)
+	}
+
+	return value, exists && value != ""
+}
+
+// findVariable returns the lowercased key and the value stored for key. The caller must hold the mutex
+func findVariable(key string) (string, string, bool) {
+	stored, exists := canonicalKey(key)
+	if !exists {
+		return "", "", false
+	}
+
+	return strings.ToLower(stored), variables[stored], true
+}
+
+// canonicalKey returns the stored key for key given in any case, with or without the prefix.
+// A config key that itself starts with the prefix wins over stripping it. The caller must hold the mutex
+func canonicalKey(key string) (string, bool) {
+	// When case variants can be applied to separate variables, an exact match reads its own value
+	if keyCasePolicy != KeyCaseLowerAll {
+		if _, exists := variables[key]; exists {
+			return key, true
+		}
+		if stripped := stripPrefix(key); stripped != key {
+			if _, exists := variables[stripped]; exists {
+				return stripped, true
+			}
+		}
+	}
+
+	key = strings.ToLower(key)
+	if stored, exists := keyIndex[key]; exists {
+		return stored, true
+	}
+
+	if stripped := stripPrefix(key); stripped != key {
+		if stored, exists := keyIndex[stripped]; exists {
+			return stored, true
+		}
+	}
+
+	return "", false
+}
+
+// storeValue stores value under key, array reporting whether it is an array value. Of keys
+// differing only in case, the last in sorted order supplies the value, as it is also the one
+// applyVariables applies last. The caller must hold the mutex
+func storeValue(key, value string, array bool) {
+	variables[key] = value
+	if array {
+		arrayKeys[key] = true
+	} else {
+		delete(arrayKeys, key)
+	}
+
+	lower := strings.ToLower(key)
+	if current, exists := keyIndex[lower]; !exists || key >= current {
+		keyIndex[lower] = key
+	}
+}
+
+// deleteValue removes key, handing its index entry to any key differing only in case.
+// The caller must hold the mutex
+func deleteValue(key string) {
+	delete(variables, key)
+	delete(arrayKeys, key)
+
+	lower := strings.ToLower(key)
+	if keyIndex[lower] != key {
+		return
+	}
+
+	delete(keyIndex, lower)
+	for other := range variables {
+		if strings.ToLower(other) == lower {
+			if current, exists := keyIndex[lower]; !exists || other > current {
+				keyIndex[lower] = other
+			}
+		}
+	}
+}
+
+// IncludeGraph returns a copy of the include graph recorded during load,
+// mapping each file to the files, URLs, directory entries and glob matches it included
+func IncludeGraph() map[string][]string {
 	mutex.RLock()
 	defer mutex.RUnlock()
 
-	// Only add the prefix if the key doesn't already contain the prefix
-	envKey := key
-	if !strings.HasPrefix(key, prefix) {
-		envKey = prefix + key
+	graph := make(map[string][]string, len(includeGraph))
+	for parent, children := range includeGraph {
+		graph[parent] = append([]string(nil), children...)
 	}
 
-	if value, exists := variables[envKey]; exists && value != "" {
-		return value
+	return graph
+}
+
+// LoadedFiles returns the sorted paths of every file loaded so far, including included files.
+// URL includes are listed by their URL
+func LoadedFiles() []string {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	files := make([]string, 0, len(loadedFiles))
+	for file := range loadedFiles {
+		files = append(files, file)
 	}
 
-	return defaultValue
+	// URL includes aren't tracked as loaded files, only as include graph edges
+	for _, children := range includeGraph {
+		for _, child := range children {
+			if (strings.HasPrefix(child, "http://") || strings.HasPrefix(child, "https://")) && !slices.Contains(files, child) {
+				files = append(files, child)
+			}
+		}
+	}
+
+	sort.Strings(files)
+	return files
 }
 
-// loadFile handles the actual file loading logic
-func loadFile(filePath string) error {
-    mutex.Lock()
-    if loadedFiles[filePath] {
-        mutex.Unlock()
-        return nil // Skip already loaded files
-    }
-    loadedFiles[filePath] = true
-    mutex.Unlock()
+// Range calls fn for each loaded key and value in sorted key order, stopping when fn returns false.
+// Keys are reported as applied, including the prefix. It iterates over a snapshot taken under the
+// read lock, so fn may safely call other functions of this package
+func Range(fn func(key, value string) bool) {
+	mutex.RLock()
+	keys := make([]string, 0, len(keyIndex))
+	snapshot := make(map[string]string, len(keyIndex))
+	for _, stored := range keyIndex {
+		key := envName(stored)
+		keys = append(keys, key)
+		snapshot[key] = variables[stored]
+	}
+	mutex.RUnlock()
 
-    file, err := os.Open(filePath)
-    if err != nil {
-        if os.IsNotExist(err) {
-            return fmt.Errorf("file does not exist: %s", filePath)
-        }
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !fn(key, snapshot[key]) {
+			return
+		}
+	}
+}
+
+// loadFile handles the actual file loading logic. Files that were already loaded are skipped
+// unless always is set, which re-parses them as long as they don't include themselves
+func loadFile(filePath string, always bool) error {
+	mutex.Lock()
+	if always && parsingFiles[filePath] {
+		mutex.Unlock()
+		return fmt.Errorf("include cycle: %s includes itself", filePath)
+	}
+	if loadedFiles[filePath] && !always {
+		mutex.Unlock()
+		return nil // Skip already loaded files
+	}
+	markLoaded(filePath)
+	parsingFiles[filePath] = true
+	mutex.Unlock()
+
+	defer func() {
+		mutex.Lock()
+		delete(parsingFiles, filePath)
+		mutex.Unlock()
+	}()
 
-        return fmt.Errorf("failed to open config file %s: %w", filePath, err)
-    }
+	file, err := openConfigFile(filePath)
+	if err != nil {
+		forgetFile(filePath)
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%w: %s", ErrFileNotFound, filePath)
+		}
+
+		return fmt.Errorf("failed to open config file %s: %w", filePath, err)
+	}
 
-    defer file.Close()
+	defer file.Close()
 
-    scanner := bufio.NewScanner(file)
-    var keyStack []string
-    lineNum := 0
+	return parseReader(decodeReader(file, configuredEncoding()), filePath)
+}
 
-    for scanner.Scan() {
-        lineNum++
-        line := strings.TrimSpace(scanner.Text())
+// parseReader parses HOCON from r, reporting errors and origins against name. It is shared by
+// files, URL includes and LoadReader so they all follow the same rules
+func parseReader(r io.Reader, name string) error {
+	return parseWith(r, name, newParseState())
+}
+
+// parseWith parses HOCON from r into state
+func parseWith(r io.Reader, name string, state *parseState) error {
+	reader := bufio.NewReader(r)
+	if isBinary(reader) {
+		return fmt.Errorf("not a text config file: %s", name)
+	}
 
-        // Skip comments and empty lines
-        if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
-            continue
-        }
+	scanner := bufio.NewScanner(reader)
+	defer state.flush()
+	lineNum := 0
 
-        if err := parseLine(line, &keyStack, filePath, lineNum); err != nil {
-            return err
-        }
-    }
+	// A line ending in a backslash continues onto the next one
+	continued := ""
+	startLine := 0
 
-    if err := scanner.Err(); err != nil {
-        return fmt.Errorf("error reading file %s: %w", filePath, err)
-    }
+	// A quoted value left open at the end of a line continues verbatim until its closing quote
+	quoted := ""
+
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+
+		if quoted != "" {
+			quoted += "\n" + scanner.Text()
+			if hasOpenQuote(quoted) {
+				continue
+			}
+			line, quoted = strings.TrimSpace(quoted), ""
+		} else {
+			if continued != "" {
+				line = continued + line
+			} else if line == "" || isComment(line) {
+				// Skip comments and empty lines, keeping annotations for the next key
+				state.collectAnnotation(line)
+				continue
+			} else {
+				startLine = lineNum
+			}
+
+			var more bool
+			line, more = splitContinuation(line)
+			if more {
+				continued = line
+				continue
+			}
+			continued = ""
+
+			if opensQuotedValue(line) {
+				quoted = line
+				continue
+			}
+		}
+
+		if err := parseLine(line, state, name, startLine); err != nil {
+			return err
+		}
+	}
 
-    // Apply variables to environment
-    return applyVariables()
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading %s: %w", name, err)
+	}
+
+	if quoted != "" {
+		return markError(ErrSyntax, fmt.Errorf("unterminated quoted value at %s:%d", name, startLine))
+	}
+
+	// A backslash on the last line has nothing to continue onto
+	if continued != "" {
+		if err := parseLine(continued, state, name, startLine); err != nil {
+			return err
+		}
+	}
+
+	if len(state.keyStack) > state.inherited {
+		return markError(ErrSyntax, fmt.Errorf("unclosed block '%s' in %s", state.keyStack[len(state.keyStack)-1], name))
+	}
+
+	return nil
+}
+
+// forgetFile clears the loaded mark of a file that couldn't be opened, so a later include can retry it
+func forgetFile(filePath string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	delete(loadedFiles, filePath)
+}
+
+// loadByExtension parses a file passed to Load with the parser matching its extension.
+// Files with an unknown extension are parsed as HOCON
+func loadByExtension(filePath string) error {
+	switch ext := strings.ToLower(filepath.Ext(filePath)); ext {
+	case ".json":
+		return loadJSONFile(filePath)
+	case ".properties":
+		return loadPropertiesFile(filePath)
+	case "", ".conf", ".hocon":
+		return loadFile(filePath, false)
+	default:
+		warn("Unknown config file extension %s, parsing %s as HOCON", ext, filePath)
+		return loadFile(filePath, false)
+	}
+}
+
+// splitContinuation reports whether line ends in a continuation backslash and returns the line
+// without it. Trailing backslashes pair up as escapes, so a line ending in \\ ends with a
+// literal backslash instead of continuing
+func splitContinuation(line string) (string, bool) {
+	trailing := len(line) - len(strings.TrimRight(line, "\\"))
+	if trailing%2 == 0 {
+		return line[:len(line)-trailing/2], false
+	}
+
+	return line[:len(line)-1-trailing/2], true
+}
+
+// hasOpenQuote reports whether line ends inside a double-quoted string. Quotes in a trailing
+// comment don't count
+func hasOpenQuote(line string) bool {
+	_, open := scanComment(line)
+	return open
+}
+
+// opensQuotedValue reports whether line assigns a value that starts with a double quote which is
+// still open at the end of the line. A stray quote later in a value doesn't start a multi-line value
+func opensQuotedValue(line string) bool {
+	_, value, ok := strings.Cut(line, "=")
+	return ok && strings.HasPrefix(strings.TrimSpace(value), "\"") && hasOpenQuote(line)
+}
+
+// isBinary sniffs the start of the input for NUL bytes, which never appear in text config
+func isBinary(reader *bufio.Reader) bool {
+	head, _ := reader.Peek(sniffLen)
+	return bytes.IndexByte(head, 0) != -1
 }
 
 // parseLine handles parsing of individual HOCON lines
-func parseLine(line string, keyStack *[]string, filePath string, lineNum int) error {
-	if strings.HasPrefix(line, "include ") {
-		return handleInclude(line, filePath)
+func parseLine(line string, state *parseState, filePath string, lineNum int) error {
+	// A closing brace may be followed by a comment or by more content such as "} other {"
+	if strings.HasPrefix(line, "}") {
+		if len(state.keyStack) == state.inherited {
+			return markError(ErrSyntax, fmt.Errorf("unexpected '}' without matching '{' at %s:%d", filePath, lineNum))
+		}
+		state.keyStack = state.keyStack[:len(state.keyStack)-1]
+
+		rest := strings.TrimSpace(line[1:])
+		if rest == "" || isComment(rest) {
+			return nil
+		}
+		return parseLine(rest, state, filePath, lineNum)
 	}
 
-	// Handle nested blocks
-	if strings.HasSuffix(line, "{") {
-		key := strings.TrimSpace(strings.TrimSuffix(line, "{"))
-		*keyStack = append(*keyStack, key)
+	// Handle nested blocks, tolerating a trailing comment after the opening brace
+	if opener := stripInlineComment(line); strings.HasSuffix(opener, "{") {
+		key := strings.TrimSpace(strings.TrimSuffix(opener, "{"))
+		if !isMarkerBlock(key) {
+			key = unquoteKey(key)
+			state.attachAnnotations(buildFullKey(state.keyStack, key))
+		}
+		state.envName = ""
+		state.keyStack = append(state.keyStack, key)
 		return nil
 	}
 
-	if line == "}" {
-		if len(*keyStack) > 0 {
-			*keyStack = (*keyStack)[:len(*keyStack)-1]
-		}
+	// Everything inside a profile block that wasn't selected is skipped
+	if inInactiveProfile(state.keyStack) || skipFragment(state) {
+		state.annotations = nil
+		state.envName = ""
 		return nil
 	}
 
+	if strings.HasPrefix(line, "include ") {
+		return state.include(line, filePath)
+	}
+
+	// An @parent directive loads the file this one extends
+	if rest, ok := strings.CutPrefix(line, "@parent "); ok {
+		return state.loadParent(strings.TrimSpace(rest), filePath, lineNum)
+	}
+
+	// require_env is only a directive without =, otherwise it is an ordinary key
+	if rest, ok := strings.CutPrefix(line, "require_env "); ok && !strings.HasPrefix(strings.TrimSpace(rest), "=") {
+		return handleRequireEnv(line, filePath, lineNum)
+	}
+
+	// A secret directive redacts the key in exported output
+	if rest, ok := strings.CutPrefix(line, "secret "); ok && !strings.HasPrefix(strings.TrimSpace(rest), "=") {
+		if state.handler != nil {
+			return nil // Parse stores nothing, so there is nothing to redact
+		}
+		return handleSecret(line, state.keyStack, filePath, lineNum)
+	}
+
+	if fn, args, ok := lookupDirective(line); ok {
+		state.flush()
+		return runDirective(fn, args, state, filePath, lineNum)
+	}
+
+	// A default assignment only takes effect if the key isn't assigned anywhere else
+	isDefault := false
+	if rest, ok := strings.CutPrefix(line, "default "); ok && !strings.HasPrefix(strings.TrimSpace(rest), "=") {
+		line = strings.TrimSpace(rest)
+		isDefault = true
+	}
+
 	// Parse key-value pairs
 	parts := strings.SplitN(line, "=", 2)
 	if len(parts) != 2 {
-		return fmt.Errorf("invalid syntax at %s:%d: %s", filePath, lineNum, line)
+		return fmt.Errorf("%w at %s:%d: %s", ErrSyntax, filePath, lineNum, line)
 	}
 
-	key := strings.TrimSpace(parts[0])
+	key, appending := cutAppendKey(strings.TrimSpace(parts[0]))
+	key = unquoteKey(key)
 	value := strings.TrimSpace(parts[1])
 
 	// Handle includes
 	if strings.HasPrefix(value, "include") {
-		return handleInclude(value, filePath)
+		return state.include(value, filePath)
 	}
 
-	// Process the value
-	value = processValue(value)
-
 	// Build the full key
-	fullKey := buildFullKey(*keyStack, key)
+	fullKey := buildFullKey(state.keyStack, key)
+
+	// Values with substitutions are resolved after all files are parsed
+	parsed := rawValue{scope: scopePath(state.keyStack), origin: location(filePath, lineNum), priority: state.priority}
+	if containsSubstitution(value) {
+		parsed.value = stripInlineComment(value)
+		parsed.substitute = true
+
+		if err := checkFunctions(parsed.value); err != nil {
+			return fmt.Errorf("%w at %s:%d", err, filePath, lineNum)
+		}
+	} else {
+		parsed.value = processValue(value)
+		parsed.array = isArrayLiteral(value)
+	}
+
+	state.assigned = true
+
+	// Parse passes assignments on without recording anything
+	if state.handler != nil {
+		state.envName = ""
+		return state.handler(fullKey, parsed.value)
+	}
+
+	parsedKeys.Add(1)
+	state.attachAnnotations(fullKey)
+	state.attachEnvName(fullKey)
+
+	if !state.accepts(fullKey) {
+		return nil
+	}
+
+	if err := state.checkMaxKeys(fullKey); err != nil {
+		return fmt.Errorf("%w at %s:%d", err, filePath, lineNum)
+	}
+
+	// An @exec value is replaced by the output of its command
+	if !parsed.substitute {
+		if keep, err := execValue(&parsed, filePath, lineNum); err != nil || !keep {
+			return err
+		}
+	}
+
+	switch {
+	case appending:
+		// Earlier values must be stored so the element can be appended to them
+		state.flush()
+		if err := storeAppend(fullKey, parsed); err != nil {
+			return fmt.Errorf("%w at %s:%d", err, filePath, lineNum)
+		}
+	case isDefault:
+		storeDefault(fullKey, parsed)
+	case parsed.substitute:
+		// Earlier literal values must be stored so the pending value can override them
+		state.flush()
+		storePending(fullKey, parsed)
+	default:
+		state.add(fullKey, parsed.value, parsed.origin, parsed.array)
+	}
+
+	return nil
+}
+
+// setVariable stores a parsed value unless the key was set with a higher include priority. origin is the location of the assignment, used when origin
+// tracking is enabled. The caller must hold the mutex
+func setVariable(fullKey, value, origin string, priority int, array bool) {
+	if !acceptPriority(fullKey, priority) {
+		return
+	}
+
+	// A literal assignment overrides any earlier assignment still waiting to be resolved
+	overridePending(fullKey)
+	delete(pendingValues, fullKey)
+	delete(unresolved, fullKey)
+	storeValue(fullKey, value, array)
+	recordOrigin(fullKey, origin)
+	recordHistory(fullKey, value)
+}
+
+// parseState is the state of a single file being parsed: the enclosing blocks and the
+// assignments parsed since they were last stored. Batching assignments means the global
+// lock is taken once per batch instead of once per key
+type parseState struct {
+	keyStack  []string
+	inherited int // Number of prefix blocks at the bottom of keyStack inherited from the including file
+	batch     map[string]batchEntry
+	priority  int  // Include priority of the file being parsed
+	history   bool // Whether every assignment must reach the store, not just the last per key
+	assigned  bool // Whether the file has assigned a key yet, after which it can't declare an @parent
+
+	inFragment  bool              // Whether the file was included from inside a selected fragment
+	annotate    bool              // Whether annotation comments are collected
+	envName     string            // Environment variable named by an @env comment for the next key
+	annotations map[string]string // Annotations waiting for the next key
+
+	handler  func(key, value string) error // Receives assignments instead of the store when streaming with Parse
+	streamed map[string]bool               // Files already parsed by the same Parse call
+
+	filter func(key string) bool // Key filter of LoadFiltered, or nil
+}
+
+// batchEntry is an assignment waiting in a parseState batch
+type batchEntry struct {
+	value  string
+	origin string
+	array  bool
+}
+
+func newParseState() *parseState {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return &parseState{
+		keyStack:   append([]string(nil), includePrefixes...),
+		inherited:  len(includePrefixes),
+		batch:      make(map[string]batchEntry),
+		priority:   includePriority,
+		history:    trackHistory,
+		inFragment: fragmentInclude,
+		annotate:   parseAnnotations,
+		filter:     keyFilter,
+	}
+}
+
+// accepts reports whether the key filter of the load lets fullKey through. The filter is called
+// without holding the mutex, so it can use the package accessors
+func (s *parseState) accepts(fullKey string) bool {
+	return s.filter == nil || s.filter(fullKey)
+}
+
+// set records an assignment in the batch unless the key filter rejects it. It fails if the key
+// would exceed the limit set with SetMaxKeys
+func (s *parseState) set(fullKey, value, origin string, array bool) error {
+	if !s.accepts(fullKey) {
+		return nil
+	}
+
+	if err := s.checkMaxKeys(fullKey); err != nil {
+		return err
+	}
+
+	s.add(fullKey, value, origin, array)
+	return nil
+}
+
+// add records an assignment in the batch; a later assignment to the same key replaces it
+// unless history is tracked, in which case the earlier one is stored first
+func (s *parseState) add(fullKey, value, origin string, array bool) {
+	if _, exists := s.batch[fullKey]; exists && s.history {
+		s.flush()
+	}
+	s.batch[fullKey] = batchEntry{value: value, origin: origin, array: array}
+}
+
+// include stores the pending assignments, so values from the include override them, and then
+// processes the include
+func (s *parseState) include(spec, filePath string) error {
+	if s.handler != nil {
+		return s.streamInclude(spec, filePath)
+	}
+
+	return s.includeWith(func() error {
+		return handleInclude(spec, filePath)
+	})
+}
+
+// includeWith runs load with the pending assignments stored and the include state of the
+// current position, shared by includes and parent files
+func (s *parseState) includeWith(load func() error) error {
+	s.flush()
+
+	previous := swapFragmentInclude(s.insideFragment())
+	defer swapFragmentInclude(previous)
+
+	previousPrefixes := swapIncludePrefixes(s.prefixBlocks())
+	defer swapIncludePrefixes(previousPrefixes)
+
+	return load()
+}
+
+// flush stores the batched assignments under a single lock
+func (s *parseState) flush() {
+	if len(s.batch) == 0 {
+		return
+	}
 
-	// Store the variable
 	mutex.Lock()
-	variables[fullKey] = value
-	mutex.Unlock()
+	defer mutex.Unlock()
+
+	for key, entry := range s.batch {
+		setVariable(key, entry.value, entry.origin, s.priority, entry.array)
+	}
+
+	s.batch = make(map[string]batchEntry)
+}
+
+// handleRequireEnv asserts that the environment variable named by a require_env directive is present
+func handleRequireEnv(line string, filePath string, lineNum int) error {
+	name := strings.TrimSpace(strings.TrimPrefix(line, "require_env"))
+	name = strings.Trim(name, "\"'")
+
+	if name == "" {
+		return fmt.Errorf("%w at %s:%d: %s", ErrSyntax, filePath, lineNum, line)
+	}
+
+	if os.Getenv(name) == "" {
+		return fmt.Errorf("required environment variable %s is not set (%s:%d)", name, filePath, lineNum)
+	}
 
 	return nil
 }
 
 // processValue handles value processing including quote removal and comment stripping
 func processValue(value string) string {
+	value = stripInlineComment(value)
+
 	// Remove quotes
-	if strings.HasPrefix(value, "\"") && strings.HasSuffix(value, "\"") {
+	quoted := false
+	if len(value) >= 2 && strings.HasPrefix(value, "\"") && strings.HasSuffix(value, "\"") {
 		value = value[1 : len(value)-1]
+		quoted = true
 	}
 
-	// Remove inline comments
-	if idx := strings.Index(value, "#"); idx != -1 {
-		value = value[:idx]
+	// Quoted values are strings, so only unquoted numbers get normalized
+	if !quoted {
+		value = normalizeNumber(value)
+	}
+
+	return value
+}
+
+// stripInlineComment removes a trailing comment, starting with # or // unless changed with
+// SetCommentPrefixes. As in HOCON, a comment only starts outside quotes and when preceded by
+// whitespace, so unquoted URLs such as http://example.com/#section are kept intact
+func stripInlineComment(value string) string {
+	if i, _ := scanComment(value); i != -1 {
+		return strings.TrimSpace(value[:i])
 	}
 
 	return strings.TrimSpace(value)
 }
 
+// normalizeNumber strips digit separators and adds a leading zero to bare fractions,
+// so "1_000" becomes "1000" and "-.5" becomes "-0.5". A leading sign is preserved as written.
+// Non-numeric values, including a lone sign, are returned unchanged
+func normalizeNumber(value string) string {
+	match := numberPattern.FindStringSubmatch(value)
+	if match == nil || (match[2] == "" && match[3] == "") {
+		return value
+	}
+
+	intPart := match[2]
+	if intPart == "" {
+		intPart = "0"
+	}
+
+	return match[1] + strings.ReplaceAll(intPart+match[3], "_", "")
+}
+
+// unquoteKey removes the quotes from a key such as "X-Api-Key", so keys that aren't valid
+// unquoted can be written. Dots inside quotes still separate path elements
+func unquoteKey(key string) string {
+	return strings.ReplaceAll(key, "\"", "")
+}
+
 // buildFullKey constructs the full key path
 func buildFullKey(keyStack []string, key string) string {
-	if len(keyStack) > 0 {
-		return strings.Join(keyStack, ".") + "." + key
+	if path := scopePath(keyStack); len(path) > 0 {
+		return strings.Join(path, ".") + "." + key
 	}
 	return key
 }
 
+// isMarkerBlock reports whether blockKey opens a profile, fragment or prefix block rather than an object
+func isMarkerBlock(blockKey string) bool {
+	_, isProfile := profileName(blockKey)
+	_, isFragment := fragmentName(blockKey)
+	_, isPrefix := prefixBlockName(blockKey)
+	return isProfile || isFragment || isPrefix
+}
+
+// scopePath returns the object path of the enclosing blocks
+func scopePath(keyStack []string) []string {
+	var path []string
+	for _, blockKey := range keyStack {
+		if name, ok := prefixBlockName(blockKey); ok {
+			path = append(path, name)
+			continue
+		}
+
+		// Profile and fragment blocks select keys but don't contribute to the key path
+		if !isMarkerBlock(blockKey) {
+			path = append(path, blockKey)
+		}
+	}
+	return path
+}
+
 // handleInclude processes include directives
 func handleInclude(value string, currentFile string) error {
 	// Remove "include" keyword and trim spaces
 	includeStr := strings.TrimSpace(strings.TrimPrefix(value, "include"))
 
+	// Conditional includes are skipped entirely when the predicate is false
+	if strings.HasPrefix(includeStr, "if(") {
+		matched, rest, err := evaluateIncludeCondition(includeStr)
+		if err != nil {
+			return fmt.Errorf("%w in %s", err, currentFile)
+		}
+
+		if !matched {
+			return nil
+		}
+
+		includeStr = rest
+	}
+
+	// Values from a prioritized include only override values of equal or lower priority
+	if strings.HasPrefix(includeStr, "priority(") {
+		priority, rest, err := parseIncludePriority(includeStr)
+		if err != nil {
+			return fmt.Errorf("%w in %s", err, currentFile)
+		}
+
+		previous := swapIncludePriority(priority)
+		defer swapIncludePriority(previous)
+
+		includeStr = rest
+	}
+
 	// Parse include type and path
 	isRequired := true
 
@@ -201,6 +1221,74 @@ func handleInclude(value string, currentFile string) error {
 		includeStr = strings.TrimSpace(strings.TrimPrefix(includeStr, "required"))
 	}
 
+	// include always re-includes a file even if it was already loaded
+	always := false
+	if strings.HasPrefix(includeStr, "always ") {
+		always = true
+		includeStr = strings.TrimSpace(strings.TrimPrefix(includeStr, "always"))
+	}
+
+	// A trailing or "hint" is added to the error when the include fails
+	includeStr, hint := splitIncludeHint(includeStr)
+
+	// A trailing timeout(duration) overrides the client timeout for URL includes
+	includeStr, timeout, err := splitIncludeTimeout(includeStr)
+	if err != nil {
+		return fmt.Errorf("%w in %s", err, currentFile)
+	}
+	if timeout > 0 && !hasURLTarget(includeStr) {
+		return fmt.Errorf("include timeout(...) only applies to URL includes in %s: %s", currentFile, includeStr)
+	}
+	if timeout > 0 {
+		previous := swapIncludeTimeout(timeout)
+		defer swapIncludeTimeout(previous)
+	}
+
+	// A trailing lines(from-to) only loads part of a file
+	includeStr, lines, err := splitIncludeLines(includeStr)
+	if err != nil {
+		return fmt.Errorf("%w in %s", err, currentFile)
+	}
+
+	// Keys from a defaults(...) include only apply where nothing else sets them
+	if strings.HasPrefix(includeStr, "defaults(") {
+		target, rest, ok := splitParenthesized(strings.TrimPrefix(includeStr, "defaults"))
+		if !ok || strings.TrimSpace(rest) != "" {
+			return fmt.Errorf("invalid defaults(...) include in %s: %s", currentFile, includeStr)
+		}
+
+		previous := swapIncludePriority(defaultsPriority)
+		defer swapIncludePriority(previous)
+
+		includeStr = strings.TrimSpace(target)
+	}
+
+	if primary, fallback, found := cutIncludeKeyword(includeStr, "fallback"); found {
+		// A local file can stand in for a primary include, usually a URL, that fails
+		err = handleFallbackInclude(primary, fallback, isRequired, currentFile)
+	} else if lines != nil {
+		err = handleLinesInclude(includeStr, lines, isRequired, currentFile)
+	} else if always {
+		err = handleAlwaysInclude(includeStr, isRequired, currentFile)
+	} else if strings.HasPrefix(includeStr, "first(") {
+		// The first candidate that can be included wins
+		args, rest, ok := splitParenthesized(strings.TrimPrefix(includeStr, "first"))
+		if !ok || strings.TrimSpace(rest) != "" {
+			return fmt.Errorf("invalid first(...) include in %s: %s", currentFile, includeStr)
+		}
+		err = handleFirstInclude(args, isRequired, currentFile)
+	} else {
+		err = dispatchInclude(includeStr, isRequired, currentFile)
+	}
+
+	if err != nil && hint != "" {
+		err = fmt.Errorf("%w (hint: %s)", err, hint)
+	}
+	return markError(ErrIncludeFailed, err)
+}
+
+// dispatchInclude loads a single include target such as "file.conf", url(...) or directory(...)
+func dispatchInclude(includeStr string, isRequired bool, currentFile string) error {
 	// Handle quoted strings
 	includeStr = strings.Trim(includeStr, "\"'")
 
@@ -211,7 +1299,25 @@ func handleInclude(value string, currentFile string) error {
 		urlStr := strings.TrimPrefix(includeStr, "url(")
 		urlStr = strings.TrimSuffix(urlStr, ")")
 		urlStr = strings.Trim(urlStr, "\"'")
-		return handleURLInclude(urlStr, isRequired)
+		return handleURLInclude(urlStr, isRequired, currentFile)
+
+	case strings.HasPrefix(includeStr, "http://") || strings.HasPrefix(includeStr, "https://"):
+		// Quoted URLs are URL includes as well
+		return handleURLInclude(includeStr, isRequired, currentFile)
+
+	case strings.HasPrefix(includeStr, "json("):
+		// JSON includes
+		jsonStr := strings.TrimPrefix(includeStr, "json(")
+		jsonStr = strings.TrimSuffix(jsonStr, ")")
+		jsonStr = strings.Trim(jsonStr, "\"'")
+		return handleJSONInclude(jsonStr, isRequired, currentFile)
+
+	case strings.HasPrefix(includeStr, "properties("):
+		// Properties file includes
+		propertiesStr := strings.TrimPrefix(includeStr, "properties(")
+		propertiesStr = strings.TrimSuffix(propertiesStr, ")")
+		propertiesStr = strings.Trim(propertiesStr, "\"'")
+		return handlePropertiesInclude(propertiesStr, isRequired, currentFile)
 
 	case strings.HasPrefix(includeStr, "directory("):
 		// Directory includes
@@ -226,28 +1332,111 @@ func handleInclude(value string, currentFile string) error {
 
 	default:
 		// Regular file include
-		return handleFileInclude(includeStr, isRequired, currentFile)
+		return handleFileInclude(includeStr, isRequired, currentFile, false)
 	}
 }
 
-// applyVariables applies the stored variables to environment variables
-func applyVariables() error {
+// storeDefault records a fallback value declared with the default directive
+func storeDefault(fullKey string, value rawValue) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	defaults[fullKey] = value
+}
+
+// applyDefaults stores every recorded default whose key wasn't assigned by any loaded file
+func applyDefaults() {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for key, value := range defaults {
+		if _, exists := keyIndex[strings.ToLower(key)]; exists {
+			continue
+		}
+		if _, exists := pendingValues[key]; exists {
+			continue
+		}
+
+		if value.substitute {
+			value.history = reserveHistory(key)
+			pendingValues[key] = value
+		} else {
+			storeValue(key, value.value, value.array)
+			recordOrigin(key, value.origin)
+			recordHistory(key, value.value)
+		}
+	}
+
+	defaults = make(map[string]rawValue)
+}
+
+// checkEnvCollisions warns about distinct keys that map to the same environment variable, in which
+// case applyVariables uses the value of the last key in sorted order
+func checkEnvCollisions() {
 	mutex.Lock()
 	defer mutex.Unlock()
 
-	// Create a new map with prefixed keys
-	prefixedVariables := make(map[string]string)
-	for key, value := range variables {
-		prefixedKey := prefix + strings.ToLower(strings.ReplaceAll(key, ".", "."))
-		prefixedVariables[prefixedKey] = value
+	keys := make([]string, 0, len(variables))
+	for key := range variables {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
 
-		if err := os.Setenv(prefixedKey, value); err != nil {
-			return fmt.Errorf("failed to set environment variable %s: %w", prefixedKey, err)
+	sources := make(map[string]string)
+	for _, key := range keys {
+		envKey := envName(key)
+		if previous, exists := sources[envKey]; exists {
+			recordWarning("Config keys %s and %s both map to environment variable %s, using the value of %s", previous, key, envKey, key)
 		}
+		sources[envKey] = key
 	}
+}
 
-	// Replace the original variables map with the prefixed version
-	variables = prefixedVariables
+// applyVariables applies the stored variables to environment variables in sorted key order,
+// so when several keys map to the same variable the result is the same on every run
+func applyVariables() error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	keys := make([]string, 0, len(variables))
+	for key := range variables {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// Keys are stored as written, the environment variable names are derived here. If a
+	// variable can't be set, the ones already set are restored
+	var applied []envValue
+	for _, key := range keys {
+		for _, variable := range arrayEnvValues(envName(key), variables[key], arrayKeys[key]) {
+			name := variable.name
+			previous, existed := os.LookupEnv(name)
+
+			if err := os.Setenv(name, variable.value); err != nil {
+				restoreEnv(applied)
+				return fmt.Errorf("failed to set environment variable %s: %w", name, err)
+			}
+			applied = append(applied, envValue{name: name, value: previous, existed: existed})
+		}
+	}
 
 	return nil
 }
+
+// envValue is the state of an environment variable before it was set
+type envValue struct {
+	name    string
+	value   string
+	existed bool
+}
+
+// restoreEnv restores environment variables to their recorded state, most recent first
+func restoreEnv(values []envValue) {
+	for i := len(values) - 1; i >= 0; i-- {
+		if values[i].existed {
+			os.Setenv(values[i].name, values[i].value)
+		} else {
+			os.Unsetenv(values[i].name)
+		}
+	}
+}
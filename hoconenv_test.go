@@ -1,11 +1,20 @@
 package hoconenv
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"time"
 )
 
 // Helper functions
@@ -19,6 +28,7 @@ func setupTestEnv(t *testing.T) func() {
 		t.Fatal(err)
 	}
 	os.Chdir(tempDir)
+	Reset()
 
 	return func() {
 		os.Chdir(originalWd)
@@ -37,6 +47,35 @@ func createTempConfig(t *testing.T, name, content string) {
 	}
 }
 
+// loadDuring runs load and, while it is waiting on the URL it is given, starts other, so other
+// runs at the same time as load. It waits for both and reports their errors
+func loadDuring(t *testing.T, load func(url string) error, other func() error) {
+	t.Helper()
+
+	reached, release := make(chan struct{}), make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(reached)
+		<-release
+	}))
+	defer server.Close()
+
+	loadErr := make(chan error, 1)
+	go func() { loadErr <- load(server.URL) }()
+	<-reached
+
+	otherErr := make(chan error, 1)
+	go func() { otherErr <- other() }()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	if err := <-loadErr; err != nil {
+		t.Errorf("Load failed: %v", err)
+	}
+	if err := <-otherErr; err != nil {
+		t.Errorf("Concurrent load failed: %v", err)
+	}
+}
+
 func assertNoError(t *testing.T, err error) {
 	t.Helper()
 	if err != nil {
@@ -260,6 +299,56 @@ host = "localhost"
 	}
 }
 
+func TestPrefixLookup(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "prefix_lookup.conf", `
+host = "localhost"
+production.mode = "strict"
+prod {
+	region = "eu"
+}
+`)
+
+	SetPrefix("Prod.")
+
+	err := Load("prefix_lookup.conf")
+	assertNoError(t, err)
+
+	tests := []struct {
+		key      string
+		expected string
+	}{
+		{"host", "localhost"},
+		{"prod.host", "localhost"},
+		{"PROD.Host", "localhost"},
+		{"production.mode", "strict"},
+		{"prod.production.mode", "strict"},
+		{"prod.region", "eu"},
+		{"prod.prod.region", "eu"},
+		{"region", "missing"},
+	}
+
+	for _, tt := range tests {
+		if got := GetDefaultValue(tt.key, "missing"); got != tt.expected {
+			t.Errorf("GetDefaultValue(%s) = %q; want %q", tt.key, got, tt.expected)
+		}
+	}
+
+	if got := StripPrefix("PROD.host"); got != "host" {
+		t.Errorf("StripPrefix(PROD.host) = %q; want %q", got, "host")
+	}
+	if got := StripPrefix("production.mode"); got != "production.mode" {
+		t.Errorf("StripPrefix(production.mode) = %q; want unchanged", got)
+	}
+
+	SetPrefix("")
+	if got := StripPrefix("prod.host"); got != "prod.host" {
+		t.Errorf("StripPrefix with no prefix = %q; want unchanged", got)
+	}
+}
+
 func TestDefaultValue(t *testing.T) {
 	cleanup := setupTestEnv(t)
 	defer cleanup()
@@ -287,3 +376,4123 @@ database {
 		t.Errorf("Expected '5432', got '%s'", value)
 	}
 }
+
+func TestIncludeGraph(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	os.Mkdir("graph.d", 0755)
+	createTempConfig(t, "graph.d/extra.conf", "graph.extra = 1")
+	createTempConfig(t, "graph_sub.conf", "graph.sub = 1")
+	createTempConfig(t, "graph_glob1.conf", "graph.glob = 1")
+
+	content := `
+include "graph_sub.conf"
+include directory("graph.d")
+include "graph_glob*.conf"
+`
+	createTempConfig(t, "graph.conf", content)
+
+	err := Load("graph.conf")
+	assertNoError(t, err)
+
+	graph := IncludeGraph()
+	expected := []string{"graph_sub.conf", "graph.d/extra.conf", "graph_glob1.conf"}
+	if !reflect.DeepEqual(graph["graph.conf"], expected) {
+		t.Errorf("IncludeGraph()[graph.conf] = %v; want %v", graph["graph.conf"], expected)
+	}
+}
+
+func TestRequireEnv(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	t.Setenv("HOCONENV_TEST_PASSWORD", "secret")
+
+	content := `
+require_env "HOCONENV_TEST_PASSWORD"
+require.present = "yes"
+`
+	createTempConfig(t, "require_env.conf", content)
+
+	err := Load("require_env.conf")
+	assertNoError(t, err)
+	assertEnvVar(t, "require.present", "yes")
+
+	createTempConfig(t, "require_env_missing.conf", `require_env "HOCONENV_TEST_MISSING"`)
+
+	err = Load("require_env_missing.conf")
+	if err == nil {
+		t.Fatal("expected an error for missing required env var, but got nil")
+	}
+
+	if !strings.Contains(err.Error(), "HOCONENV_TEST_MISSING") {
+		t.Errorf("expected error to name the missing env var, got %q", err.Error())
+	}
+
+	createTempConfig(t, "require_env_key.conf", `require_env = "x"`)
+
+	err = Load("require_env_key.conf")
+	assertNoError(t, err)
+	assertEnvVar(t, "require_env", "x")
+}
+
+func TestNumericNormalization(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	content := `
+numbers {
+	count = 1_000
+	big = 1_000_000.000_1
+	ratio = .5
+	plain = 42
+	quoted = "1_000"
+	version = v1_0
+	trailing = 1_
+}
+`
+	createTempConfig(t, "numbers.conf", content)
+
+	err := Load("numbers.conf")
+
+	assertNoError(t, err)
+	assertEnvVar(t, "numbers.count", "1000")
+	assertEnvVar(t, "numbers.big", "1000000.0001")
+	assertEnvVar(t, "numbers.ratio", "0.5")
+	assertEnvVar(t, "numbers.plain", "42")
+	assertEnvVar(t, "numbers.quoted", "1_000")
+	assertEnvVar(t, "numbers.version", "v1_0")
+	assertEnvVar(t, "numbers.trailing", "1_")
+}
+
+func TestLoadOnce(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "once.conf", `once.value = "first"`)
+
+	err := LoadOnce("once.conf")
+	assertNoError(t, err)
+	assertEnvVar(t, "once.value", "first")
+
+	// The second call must not load anything, so a missing file is not an error
+	err = LoadOnce("missing.conf")
+	assertNoError(t, err)
+
+	Reset()
+
+	err = LoadOnce("missing.conf")
+	if err == nil {
+		t.Fatal("expected an error after Reset, but got nil")
+	}
+
+	// The cached error is returned on subsequent calls
+	if again := LoadOnce("once.conf"); again != err {
+		t.Errorf("expected cached error %v, got %v", err, again)
+	}
+}
+
+func TestSignedNumbers(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	content := `
+signed {
+	offset = -5
+	delta = +3
+	fraction = -.5
+	separated = -1_000 # inline comment
+	dash = -
+	plus = +
+}
+`
+	createTempConfig(t, "signed.conf", content)
+
+	err := Load("signed.conf")
+
+	assertNoError(t, err)
+	assertEnvVar(t, "signed.offset", "-5")
+	assertEnvVar(t, "signed.delta", "+3")
+	assertEnvVar(t, "signed.fraction", "-0.5")
+	assertEnvVar(t, "signed.separated", "-1000")
+	assertEnvVar(t, "signed.dash", "-")
+	assertEnvVar(t, "signed.plus", "+")
+}
+
+func TestWriteFileRoundTrip(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "write_sub.conf", `write.version = "1.0"`)
+	content := `
+include "write_sub.conf"
+write {
+	name = "app"
+	port = 8080
+}
+`
+	createTempConfig(t, "write.conf", content)
+
+	err := Load("write.conf")
+	assertNoError(t, err)
+
+	err = WriteFile("frozen.conf")
+	assertNoError(t, err)
+
+	info, err := os.Stat("frozen.conf")
+	assertNoError(t, err)
+	if info.Mode().Perm() != 0644 {
+		t.Errorf("expected permissions 0644, got %v", info.Mode().Perm())
+	}
+
+	data, err := os.ReadFile("frozen.conf")
+	assertNoError(t, err)
+
+	expected := "write.name = \"app\"\nwrite.port = \"8080\"\nwrite.version = \"1.0\"\n"
+	if string(data) != expected {
+		t.Errorf("WriteFile content = %q; want %q", string(data), expected)
+	}
+
+	Reset()
+
+	err = Load("frozen.conf")
+	assertNoError(t, err)
+	assertEnvVar(t, "write.name", "app")
+	assertEnvVar(t, "write.port", "8080")
+	assertEnvVar(t, "write.version", "1.0")
+
+	err = WriteFile("private.conf", 0600)
+	assertNoError(t, err)
+
+	info, err = os.Stat("private.conf")
+	assertNoError(t, err)
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected permissions 0600, got %v", info.Mode().Perm())
+	}
+}
+
+func TestConditionalInclude(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	t.Setenv("HOCONENV_TEST_APP_ENV", "prod")
+
+	createTempConfig(t, "cond_prod.conf", `cond.prod = "yes"`)
+	createTempConfig(t, "cond_dev.conf", `cond.dev = "yes"`)
+	createTempConfig(t, "cond_not_dev.conf", `cond.not_dev = "yes"`)
+
+	content := `
+include if(env("HOCONENV_TEST_APP_ENV") == "prod") "cond_prod.conf"
+include if(env("HOCONENV_TEST_APP_ENV") == "dev") "cond_dev.conf"
+include if(env("HOCONENV_TEST_APP_ENV") != "dev") required "cond_not_dev.conf"
+`
+	createTempConfig(t, "cond.conf", content)
+
+	err := Load("cond.conf")
+
+	assertNoError(t, err)
+	assertEnvVar(t, "cond.prod", "yes")
+	assertEnvVar(t, "cond.dev", "")
+	assertEnvVar(t, "cond.not_dev", "yes")
+
+	createTempConfig(t, "cond_bad.conf", `include if(APP_ENV = "prod") "cond_prod.conf"`)
+
+	err = Load("cond_bad.conf")
+	if err == nil {
+		t.Fatal("expected an error for a malformed condition, but got nil")
+	}
+
+	if !strings.Contains(err.Error(), "invalid include condition") {
+		t.Errorf("expected invalid condition error, got %q", err.Error())
+	}
+}
+
+func TestRegisterLazy(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "lazy.conf", `remote.endpoint = "https://lazy.example.com"`)
+
+	calls := 0
+	RegisterLazy("remote", func() error {
+		calls++
+		return Load("lazy.conf")
+	})
+
+	if value := GetDefaultValue("local.key", "fallback"); value != "fallback" {
+		t.Errorf("Expected 'fallback', got '%s'", value)
+	}
+	if calls != 0 {
+		t.Fatalf("expected loader not to run for unrelated keys, ran %d times", calls)
+	}
+
+	if value := GetDefaultValue("remote.endpoint", ""); value != "https://lazy.example.com" {
+		t.Errorf("Expected 'https://lazy.example.com', got '%s'", value)
+	}
+
+	GetDefaultValue("remote.endpoint", "")
+	if calls != 1 {
+		t.Errorf("expected loader to run exactly once, ran %d times", calls)
+	}
+}
+
+func TestGetJSON(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	content := `
+database {
+	url = "postgresql://localhost:5432/db"
+	user = "admin"
+	pool {
+		size = 10
+	}
+}
+`
+	createTempConfig(t, "json.conf", content)
+
+	err := Load("json.conf")
+	assertNoError(t, err)
+
+	value, err := GetJSON("database")
+	assertNoError(t, err)
+
+	expected := `{"pool":{"size":"10"},"url":"postgresql://localhost:5432/db","user":"admin"}`
+	if value != expected {
+		t.Errorf("GetJSON(database) = %s; want %s", value, expected)
+	}
+
+	value, err = GetJSON("database.user")
+	assertNoError(t, err)
+	if value != `"admin"` {
+		t.Errorf("GetJSON(database.user) = %s; want %s", value, `"admin"`)
+	}
+
+	if _, err := GetJSON("missing"); err == nil {
+		t.Error("expected an error for a missing key, but got nil")
+	}
+}
+
+func TestBinaryInput(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "binary.conf", "\x7fELF\x02\x01\x01\x00\x00\x00binary = data")
+
+	err := Load("binary.conf")
+	if err == nil {
+		t.Fatal("expected an error for binary input, but got nil")
+	}
+
+	expectedErr := "not a text config file: binary.conf"
+	if err.Error() != expectedErr {
+		t.Errorf("expected error %q, got %q", expectedErr, err.Error())
+	}
+}
+
+func TestSubstitution(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	t.Setenv("HOCONENV_TEST_HOME", "/home/app")
+
+	content := `
+server {
+	host = "localhost"
+	url = "http://"${server.host}":8080"
+}
+paths.data = ${HOCONENV_TEST_HOME}/data
+paths.quoted = "${HOCONENV_TEST_HOME}"
+paths.missing = ${HOCONENV_TEST_UNDEFINED}
+paths.optional = "prefix-"${?HOCONENV_TEST_UNDEFINED}
+`
+	createTempConfig(t, "substitution.conf", content)
+
+	err := Load("substitution.conf")
+
+	assertNoError(t, err)
+	assertEnvVar(t, "server.url", "http://localhost:8080")
+	assertEnvVar(t, "paths.data", "/home/app/data")
+	assertEnvVar(t, "paths.quoted", "${HOCONENV_TEST_HOME}")
+	assertEnvVar(t, "paths.missing", "${HOCONENV_TEST_UNDEFINED}")
+	assertEnvVar(t, "paths.optional", "prefix-")
+}
+
+func TestIncludeThenOverride(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "override_base.conf", `
+database {
+	url = "postgresql://base:5432/db"
+	user = "base"
+}
+`)
+	content := `
+include "override_base.conf"
+database.url = ${?HOCONENV_TEST_DATABASE_URL}
+database.user = "override"
+`
+	createTempConfig(t, "override.conf", content)
+
+	// Without the env var the optional substitution leaves the base value in place
+	err := Load("override.conf")
+
+	assertNoError(t, err)
+	assertEnvVar(t, "database.url", "postgresql://base:5432/db")
+	assertEnvVar(t, "database.user", "override")
+
+	Reset()
+	t.Setenv("HOCONENV_TEST_DATABASE_URL", "postgresql://override:5432/db")
+
+	err = Load("override.conf")
+
+	assertNoError(t, err)
+	assertEnvVar(t, "database.url", "postgresql://override:5432/db")
+	assertEnvVar(t, "database.user", "override")
+}
+
+func TestLoadProfile(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	content := `
+app.name = "shared"
+
+profile "dev" {
+	database {
+		url = "postgresql://localhost:5432/dev"
+	}
+}
+
+profile "prod" {
+	database {
+		url = "postgresql://db.internal:5432/prod"
+	}
+	require_env "HOCONENV_TEST_NEVER_SET"
+}
+`
+	createTempConfig(t, "profiles.conf", content)
+
+	err := LoadProfile("dev", "profiles.conf")
+
+	assertNoError(t, err)
+	assertEnvVar(t, "app.name", "shared")
+	assertEnvVar(t, "database.url", "postgresql://localhost:5432/dev")
+
+	// The profile only applies to its own load, not to a load running at the same time
+	createTempConfig(t, "profiles_other.conf", "other.key = \"loaded\"")
+	loadDuring(t, func(url string) error {
+		createTempConfig(t, "profiles_plain.conf", fmt.Sprintf("include url(\"%s\")\nprofile \"dev\" {\n    plain.key = \"dev\"\n}\n", url))
+		return Load("profiles_plain.conf")
+	}, func() error {
+		return LoadProfile("dev", "profiles_other.conf")
+	})
+
+	if got := GetDefaultValue("plain.key", "unset"); got != "unset" {
+		t.Errorf("Expected a plain load to skip profile blocks, got %q", got)
+	}
+	assertEnvVar(t, "other.key", "loaded")
+}
+
+func TestDefaultFilePattern(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "application.conf", `pattern.conf = "yes"`)
+	createTempConfig(t, "application.bak", `pattern.bak = "yes"`)
+
+	SetDefaultFilePattern("application.conf", "application.hocon")
+
+	err := Load()
+
+	assertNoError(t, err)
+	assertEnvVar(t, "pattern.conf", "yes")
+	assertEnvVar(t, "pattern.bak", "")
+
+	SetDefaultFilePattern()
+
+	if err := Load(); err == nil {
+		t.Error("expected an error when default loading is disabled, but got nil")
+	}
+}
+
+func TestEncoding(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	// "café" encoded as ISO-8859-1
+	createTempConfig(t, "latin1.conf", "encoding.latin1 = \"caf\xe9\"\n")
+
+	err := SetEncoding("ISO-8859-1")
+	assertNoError(t, err)
+
+	err = Load("latin1.conf")
+	assertNoError(t, err)
+	assertEnvVar(t, "encoding.latin1", "café")
+
+	createTempConfig(t, "latin1.json", "{\"encoding\": {\"json\": \"caf\xe9\"}}")
+
+	err = Load("latin1.json")
+	assertNoError(t, err)
+	assertEnvVar(t, "encoding.json", "café")
+
+	// "encoding.utf16 = x" encoded as UTF-16LE with a byte order mark
+	utf16 := []byte{0xff, 0xfe}
+	for _, r := range "encoding.utf16 = x\n" {
+		utf16 = append(utf16, byte(r), 0)
+	}
+	createTempConfig(t, "utf16.conf", string(utf16))
+
+	err = SetEncoding("UTF-16")
+	assertNoError(t, err)
+
+	err = Load("utf16.conf")
+	assertNoError(t, err)
+	assertEnvVar(t, "encoding.utf16", "x")
+
+	if err := SetEncoding("not-an-encoding"); err == nil {
+		t.Error("expected an error for an unknown encoding, but got nil")
+	}
+}
+
+func TestIncludeURLCharset(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=ISO-8859-1")
+		w.Write([]byte("remote.charset = \"caf\xe9\""))
+	}))
+
+	defer server.Close()
+
+	createTempConfig(t, "charset.conf", `include url("`+server.URL+`")`)
+
+	err := Load("charset.conf")
+
+	assertNoError(t, err)
+	assertEnvVar(t, "remote.charset", "café")
+}
+
+func TestClose(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "close.conf", `close.value = "kept"`)
+
+	err := Load("close.conf")
+	assertNoError(t, err)
+
+	RegisterLazy("never", func() error {
+		t.Error("lazy loader should not run after Close")
+		return nil
+	})
+
+	err = Close()
+	assertNoError(t, err)
+
+	if value := GetDefaultValue("never.loaded", "default"); value != "default" {
+		t.Errorf("Expected 'default', got '%s'", value)
+	}
+
+	if value := GetDefaultValue("close.value", ""); value != "kept" {
+		t.Errorf("Expected 'kept', got '%s'", value)
+	}
+}
+
+func TestRelativeSubstitution(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	content := `
+host = "global"
+server {
+	host = "server.local"
+	url = "http://"${host}
+	admin {
+		url = ${url}"/admin"
+		port = 8080
+		endpoint = ${host}":"${port}
+	}
+}
+other.url = "http://"${host}
+`
+	createTempConfig(t, "relative.conf", content)
+
+	err := Load("relative.conf")
+
+	assertNoError(t, err)
+	assertEnvVar(t, "server.url", "http://server.local")
+	assertEnvVar(t, "server.admin.url", "http://server.local/admin")
+	assertEnvVar(t, "server.admin.endpoint", "server.local:8080")
+	assertEnvVar(t, "other.url", "http://global")
+}
+
+func TestBlockIndentationAndComments(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	content := "\tdatabase {   \n" +
+		"    \tprimary { # start of primary\n" +
+		"\t  \t\thost = \"db1\"\n" +
+		"  \t}\n" +
+		"\t\treplica { // start of replica\n" +
+		"\t\t    host = \"db2\"\n" +
+		"\t    }\n" +
+		"\tname = \"main\"\n" +
+		"}\n" +
+		"top = \"level\"\n"
+
+	createTempConfig(t, "indent.conf", content)
+
+	err := Load("indent.conf")
+
+	assertNoError(t, err)
+	assertEnvVar(t, "database.primary.host", "db1")
+	assertEnvVar(t, "database.replica.host", "db2")
+	assertEnvVar(t, "database.name", "main")
+	assertEnvVar(t, "top", "level")
+}
+
+func TestClosingBraceTrailingContent(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	content := `
+database {
+	host = "db"
+} # end of database
+cache {
+	host = "redis"
+} // end of cache
+first {
+	a = 1
+} second {
+	b = 2
+}
+outer {
+	inner {
+		c = 3
+	}} after = "top"
+last = "done"
+`
+	createTempConfig(t, "closing.conf", content)
+
+	err := Load("closing.conf")
+
+	assertNoError(t, err)
+	assertEnvVar(t, "database.host", "db")
+	assertEnvVar(t, "cache.host", "redis")
+	assertEnvVar(t, "first.a", "1")
+	assertEnvVar(t, "second.b", "2")
+	assertEnvVar(t, "outer.inner.c", "3")
+	assertEnvVar(t, "after", "top")
+	assertEnvVar(t, "last", "done")
+}
+
+func TestUnbalancedBraces(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "unclosed.conf", `
+database {
+	url = "postgresql://localhost:5432/db"
+`)
+
+	err := Load("unclosed.conf")
+	if err == nil {
+		t.Fatal("expected an error for an unclosed block, but got nil")
+	}
+
+	expectedErr := "unclosed block 'database' in unclosed.conf"
+	if err.Error() != expectedErr {
+		t.Errorf("expected error %q, got %q", expectedErr, err.Error())
+	}
+
+	createTempConfig(t, "extra_brace.conf", `
+database {
+	url = "postgresql://localhost:5432/db"
+}
+}
+`)
+
+	err = Load("extra_brace.conf")
+	if err == nil {
+		t.Fatal("expected an error for an extra closing brace, but got nil")
+	}
+
+	if !strings.Contains(err.Error(), "extra_brace.conf:5") {
+		t.Errorf("expected error to reference extra_brace.conf:5, got %q", err.Error())
+	}
+}
+
+func TestLineContinuation(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	content := `
+continued {
+	message = this is a very \
+		long value that \
+		spans lines
+	joined = abc\
+		def
+	path = C:\temp\\
+	after = "ok"
+}
+`
+	createTempConfig(t, "continuation.conf", content)
+
+	err := Load("continuation.conf")
+
+	assertNoError(t, err)
+	assertEnvVar(t, "continued.message", "this is a very long value that spans lines")
+	assertEnvVar(t, "continued.joined", "abcdef")
+	assertEnvVar(t, "continued.path", `C:\temp\`)
+	assertEnvVar(t, "continued.after", "ok")
+}
+
+func TestRegisterDirective(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	RegisterDirective("set_default", func(args string, set func(key, value string)) error {
+		key, value, found := strings.Cut(args, "=")
+		if !found {
+			return fmt.Errorf("expected key = value, got %q", args)
+		}
+		set(strings.TrimSpace(key), strings.TrimSpace(value))
+		return nil
+	})
+
+	content := `
+server {
+	set_default timeout = 30s
+	set_default = "plain assignment"
+}
+`
+	createTempConfig(t, "directive.conf", content)
+
+	err := Load("directive.conf")
+
+	assertNoError(t, err)
+	assertEnvVar(t, "server.timeout", "30s")
+	assertEnvVar(t, "server.set_default", "plain assignment")
+
+	createTempConfig(t, "directive_bad.conf", `set_default missing`)
+
+	err = Load("directive_bad.conf")
+	if err == nil {
+		t.Fatal("expected an error from the directive handler, but got nil")
+	}
+
+	if !strings.Contains(err.Error(), "directive_bad.conf:1") {
+		t.Errorf("expected error to reference directive_bad.conf:1, got %q", err.Error())
+	}
+}
+
+func TestLoadFiltered(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	content := `
+billing {
+	currency = "EUR"
+}
+shipping {
+	carrier = "dhl"
+}
+`
+	createTempConfig(t, "filtered.conf", content)
+
+	err := LoadFiltered(func(key string) bool {
+		return strings.HasPrefix(key, "billing.")
+	}, "filtered.conf")
+
+	assertNoError(t, err)
+	assertEnvVar(t, "billing.currency", "EUR")
+	assertEnvVar(t, "shipping.carrier", "")
+
+	if value := GetDefaultValue("shipping.carrier", "none"); value != "none" {
+		t.Errorf("Expected 'none', got '%s'", value)
+	}
+
+	// The filter can use the package accessors
+	createTempConfig(t, "filtered_accessor.conf", `accessor.key = "kept"`)
+	done := make(chan error, 1)
+	go func() {
+		done <- LoadFiltered(func(key string) bool { return EnvName(key) != "" }, "filtered_accessor.conf")
+	}()
+	select {
+	case err := <-done:
+		assertNoError(t, err)
+		assertEnvVar(t, "accessor.key", "kept")
+	case <-time.After(5 * time.Second):
+		t.Fatal("LoadFiltered with a filter calling EnvName did not return")
+	}
+
+	// The filter only applies to its own load, not to loads running at the same time
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		plain := fmt.Sprintf("filtered_plain_%d.conf", i)
+		other := fmt.Sprintf("filtered_other_%d.conf", i)
+		createTempConfig(t, plain, fmt.Sprintf("big.a%d = %d", i, i))
+		createTempConfig(t, other, fmt.Sprintf("small.a%d = %d", i, i))
+
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := Load(plain); err != nil {
+				t.Errorf("Load(%s) failed: %v", plain, err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			LoadFiltered(func(string) bool { return false }, other)
+		}()
+	}
+	wg.Wait()
+
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("big.a%d", i)
+		if got := GetDefaultValue(key, "unset"); got != fmt.Sprint(i) {
+			t.Errorf("Expected %s to be loaded by the plain load, got %q", key, got)
+		}
+	}
+}
+
+func TestDefaultDirective(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "defaults_base.conf", `
+default database.port = 5432
+default database.host = "localhost"
+database.name = "app"
+`)
+	content := `
+database {
+	default pool = 10
+	pool = 20
+}
+default database.user = "guest"
+include "defaults_base.conf"
+database.host = "db.internal"
+default = "a key named default"
+`
+	createTempConfig(t, "defaults.conf", content)
+
+	err := Load("defaults.conf")
+
+	assertNoError(t, err)
+	assertEnvVar(t, "database.port", "5432")
+	assertEnvVar(t, "database.host", "db.internal")
+	assertEnvVar(t, "database.pool", "20")
+	assertEnvVar(t, "database.user", "guest")
+	assertEnvVar(t, "database.name", "app")
+	assertEnvVar(t, "default", "a key named default")
+}
+
+func TestRange(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	SetPrefix("range")
+	createTempConfig(t, "range.conf", `
+b = 2
+a = 1
+c = 3
+`)
+
+	err := Load("range.conf")
+	assertNoError(t, err)
+
+	var keys []string
+	Range(func(key, value string) bool {
+		keys = append(keys, key+"="+value)
+		return true
+	})
+
+	expected := []string{"range.a=1", "range.b=2", "range.c=3"}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Range visited %v; want %v", keys, expected)
+	}
+
+	count := 0
+	Range(func(key, value string) bool {
+		count++
+		return false
+	})
+
+	if count != 1 {
+		t.Errorf("expected Range to stop after the first key, visited %d", count)
+	}
+}
+
+func TestIncludeJSON(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	data := `{
+	"service": {
+		"name": "api",
+		"port": 8080,
+		"debug": false,
+		"ratio": 0.25,
+		"unset": null,
+		"tags": ["a", "b"],
+		"backends": [{"host": "one"}, {"host": "two"}]
+	}
+}`
+	createTempConfig(t, "data.json", data)
+	createTempConfig(t, "with_json.conf", `
+include json("data.json")
+service.name = "overridden"
+`)
+
+	err := Load("with_json.conf")
+
+	assertNoError(t, err)
+	assertEnvVar(t, "service.name", "overridden")
+	assertEnvVar(t, "service.port", "8080")
+	assertEnvVar(t, "service.debug", "false")
+	assertEnvVar(t, "service.ratio", "0.25")
+	assertEnvVar(t, "service.tags.0", "a")
+	assertEnvVar(t, "service.tags.1", "b")
+	assertEnvVar(t, "service.backends.0.host", "one")
+	assertEnvVar(t, "service.backends.1.host", "two")
+
+	if _, ok := os.LookupEnv("service.unset"); ok {
+		t.Error("expected null JSON value to leave the key unset")
+	}
+}
+
+func TestIncludeProperties(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	data := `# Spring-style properties
+! also a comment
+spring.datasource.url=jdbc:postgresql://localhost:5432/db
+spring.datasource.username : admin
+server.port 8080
+app.greeting = "hello"
+app.description = a value that \
+    continues here
+app.separated = tab\tseparated
+app.path = C\:\\temp
+app.unicode = caf\u00e9
+`
+	createTempConfig(t, "app.properties", data)
+	createTempConfig(t, "with_properties.conf", `include properties("app.properties")`)
+
+	err := Load("with_properties.conf")
+
+	assertNoError(t, err)
+	assertEnvVar(t, "spring.datasource.url", "jdbc:postgresql://localhost:5432/db")
+	assertEnvVar(t, "spring.datasource.username", "admin")
+	assertEnvVar(t, "server.port", "8080")
+	assertEnvVar(t, "app.greeting", `"hello"`)
+	assertEnvVar(t, "app.description", "a value that continues here")
+	assertEnvVar(t, "app.separated", "tab\tseparated")
+	assertEnvVar(t, "app.path", `C:\temp`)
+	assertEnvVar(t, "app.unicode", "café")
+
+	createTempConfig(t, "missing_properties.conf", `include optional properties("missing.properties")`)
+
+	err = Load("missing_properties.conf")
+	assertNoError(t, err)
+}
+
+func TestForwardReferences(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "forward_a.conf", `
+greeting = "hello "${b.name}
+chain = ${b.alias}"!"
+include "forward_b.conf"
+`)
+	createTempConfig(t, "forward_b.conf", `
+b.name = "world"
+b.alias = ${c.value}
+`)
+	createTempConfig(t, "forward_c.conf", `
+c.value = "from c"
+`)
+
+	err := Load("forward_a.conf", "forward_c.conf")
+
+	assertNoError(t, err)
+	assertEnvVar(t, "greeting", "hello world")
+	assertEnvVar(t, "b.alias", "from c")
+	assertEnvVar(t, "chain", "from c!")
+}
+
+func TestOrigin(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "origin_base.conf", `
+database {
+	url = "postgresql://base:5432/db"
+	user = "base"
+}
+`)
+	createTempConfig(t, "origin.conf", `
+include "origin_base.conf"
+database.user = "override"
+database.url = ${?HOCONENV_TEST_UNDEFINED}
+`)
+
+	err := Load("origin.conf")
+	assertNoError(t, err)
+
+	if origin := Origin("database.user"); origin != "" {
+		t.Errorf("expected no origin while tracking is disabled, got %q", origin)
+	}
+
+	Reset()
+	SetTrackOrigins(true)
+
+	err = Load("origin.conf")
+	assertNoError(t, err)
+
+	if origin := Origin("database.user"); origin != "origin.conf:3" {
+		t.Errorf("Origin(database.user) = %q; want %q", origin, "origin.conf:3")
+	}
+
+	// The optional substitution is undefined, so the base value and its origin win
+	if origin := Origin("database.url"); origin != "origin_base.conf:3" {
+		t.Errorf("Origin(database.url) = %q; want %q", origin, "origin_base.conf:3")
+	}
+}
+
+func TestUnquotedURLComments(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	content := `
+links {
+	fragment = http://example.com#section
+	path = http://example.com/a//b
+	hash_comment = http://example.com # the home page
+	slash_comment = http://example.com // the home page
+	quoted = "keep # and // inside quotes"
+	quoted_comment = "quoted" # trailing comment
+}
+`
+	createTempConfig(t, "urls.conf", content)
+
+	err := Load("urls.conf")
+
+	assertNoError(t, err)
+	assertEnvVar(t, "links.fragment", "http://example.com#section")
+	assertEnvVar(t, "links.path", "http://example.com/a//b")
+	assertEnvVar(t, "links.hash_comment", "http://example.com")
+	assertEnvVar(t, "links.slash_comment", "http://example.com")
+	assertEnvVar(t, "links.quoted", "keep # and // inside quotes")
+	assertEnvVar(t, "links.quoted_comment", "quoted")
+}
+
+func TestAssignmentOrderAroundIncludes(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "order_sub.conf", `
+before = "include"
+after = "include"
+`)
+	createTempConfig(t, "order.conf", `
+before = "main"
+include "order_sub.conf"
+after = "main"
+`)
+
+	err := Load("order.conf")
+
+	assertNoError(t, err)
+	assertEnvVar(t, "before", "include")
+	assertEnvVar(t, "after", "main")
+}
+
+func BenchmarkParseLargeFile(b *testing.B) {
+	dir := b.TempDir()
+	path := filepath.Join(dir, "large.conf")
+
+	var content strings.Builder
+	for i := 0; i < 500; i++ {
+		fmt.Fprintf(&content, "section%d {\n", i)
+		for j := 0; j < 10; j++ {
+			fmt.Fprintf(&content, "\tkey%d = \"value %d-%d\" # comment\n", j, i, j)
+		}
+		content.WriteString("}\n")
+	}
+
+	if err := os.WriteFile(path, []byte(content.String()), 0644); err != nil {
+		b.Fatal(err)
+	}
+
+	// Only parsing and storing is measured; setting environment variables dominates Load otherwise
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Reset()
+		if err := loadFile(path, false); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestIncludePriority(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "priority_high.conf", `
+shared = "high"
+high.only = "high"
+`)
+	createTempConfig(t, "priority_low.conf", `
+shared = "low"
+main.value = "low"
+low.only = "low"
+`)
+	createTempConfig(t, "priority_mid.conf", `
+mid.value = "mid"
+`)
+	createTempConfig(t, "priority.conf", `
+include priority(100) "priority_high.conf"
+shared = "main"
+main.value = "main"
+mid.value = "main"
+include priority(10) "priority_low.conf"
+include "priority_mid.conf"
+`)
+
+	err := Load("priority.conf")
+
+	assertNoError(t, err)
+	assertEnvVar(t, "shared", "high")
+	assertEnvVar(t, "high.only", "high")
+	assertEnvVar(t, "main.value", "main")
+	assertEnvVar(t, "low.only", "low")
+	assertEnvVar(t, "mid.value", "mid")
+
+	createTempConfig(t, "priority_bad.conf", `include priority(high) "priority_high.conf"`)
+
+	if err := Load("priority_bad.conf"); err == nil {
+		t.Error("expected an error for an invalid priority, but got nil")
+	}
+}
+
+func TestGetDurationEnv(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "durations.conf", `
+timeouts {
+	read = 1d12h
+	write = 30s
+	broken = soon
+}
+`)
+
+	err := Load("durations.conf")
+	assertNoError(t, err)
+
+	t.Setenv("HOCONENV_TEST_TIMEOUT", "2d")
+
+	tests := []struct {
+		key      string
+		envVar   string
+		expected time.Duration
+	}{
+		{"timeouts.read", "HOCONENV_TEST_TIMEOUT", 36 * time.Hour},
+		{"timeouts.write", "HOCONENV_TEST_TIMEOUT", 30 * time.Second},
+		{"timeouts.broken", "HOCONENV_TEST_TIMEOUT", 48 * time.Hour},
+		{"timeouts.missing", "HOCONENV_TEST_TIMEOUT", 48 * time.Hour},
+		{"timeouts.missing", "HOCONENV_TEST_UNDEFINED", time.Minute},
+	}
+
+	if got := GetDuration("timeouts.write", time.Minute); got != 30*time.Second {
+		t.Errorf("GetDuration(timeouts.write) = %v; want 30s", got)
+	}
+	if got := GetDuration("timeouts.broken", time.Minute); got != time.Minute {
+		t.Errorf("GetDuration(timeouts.broken) = %v; want 1m", got)
+	}
+
+	for _, tt := range tests {
+		if got := GetDurationEnv(tt.key, tt.envVar, time.Minute); got != tt.expected {
+			t.Errorf("GetDurationEnv(%s, %s) = %v; want %v", tt.key, tt.envVar, got, tt.expected)
+		}
+	}
+}
+
+func TestGetIndex(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "index.json", `{"servers": ["alpha", "beta"]}`)
+	createTempConfig(t, "index.conf", `
+hosts = [ "a.example.com", b.example.com, "c, d" ]
+empty = []
+offsets = [-1, -2]
+name = "plain"
+include json("index.json")
+`)
+
+	err := Load("index.conf")
+	assertNoError(t, err)
+
+	tests := []struct {
+		key      string
+		index    int
+		expected string
+		ok       bool
+	}{
+		{"hosts", 0, "a.example.com", true},
+		{"hosts", 1, "b.example.com", true},
+		{"hosts", 2, "c, d", true},
+		{"hosts", 3, "", false},
+		{"hosts", -1, "", false},
+		{"offsets", 0, "-1", true},
+		{"offsets", 1, "-2", true},
+		{"offsets", 2, "", false},
+		{"servers", 1, "beta", true},
+		{"servers", 2, "", false},
+		{"empty", 0, "", false},
+		{"name", 0, "", false},
+		{"missing", 0, "", false},
+	}
+
+	for _, tt := range tests {
+		got, ok := GetIndex(tt.key, tt.index)
+		if got != tt.expected || ok != tt.ok {
+			t.Errorf("GetIndex(%s, %d) = (%q, %v); want (%q, %v)", tt.key, tt.index, got, ok, tt.expected, tt.ok)
+		}
+	}
+
+	lengths := map[string]int{"hosts": 3, "offsets": 2, "servers": 2, "empty": 0, "name": 0, "missing": 0}
+	for key, expected := range lengths {
+		if got := GetLen(key); got != expected {
+			t.Errorf("GetLen(%s) = %d; want %d", key, got, expected)
+		}
+	}
+}
+
+func TestLoadStandard(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "etc/stdapp/application.conf", `
+test.standard.source = "etc"
+test.standard.system = "yes"
+`)
+	createTempConfig(t, "application.conf", `
+test.standard.source = "local"
+`)
+
+	SetStandardSearchPaths("etc/{app}", "xdg/{app}", ".")
+
+	err := LoadStandard("stdapp")
+	assertNoError(t, err)
+	assertEnvVar(t, "test.standard.source", "local")
+	assertEnvVar(t, "test.standard.system", "yes")
+
+	err = LoadStandard("otherapp")
+	assertNoError(t, err)
+
+	SetStandardSearchPaths("etc/{app}", "xdg/{app}")
+	err = LoadStandard("otherapp")
+	if err == nil {
+		t.Error("expected error when no standard location exists")
+	}
+}
+
+func TestSecrets(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "secrets.conf", `
+database {
+	user = "admin"
+	password = "hunter2"
+	secret password
+}
+api.token = "abc123"
+secret = "not a directive"
+`)
+
+	SetPrefix("sec")
+	MarkSecret("sec.api.token")
+
+	err := Load("secrets.conf")
+	assertNoError(t, err)
+
+	if got := GetDefaultValue("database.password", ""); got != "hunter2" {
+		t.Errorf("Expected secret value to stay readable, got %q", got)
+	}
+	assertEnvVar(t, "sec.api.token", "abc123")
+
+	var buf strings.Builder
+	err = Export(&buf)
+	assertNoError(t, err)
+
+	expected := `api.token = "***"
+database.password = "***"
+database.user = "admin"
+secret = "not a directive"
+`
+	if buf.String() != expected {
+		t.Errorf("Export() =\n%s\nwant\n%s", buf.String(), expected)
+	}
+
+	err = WriteFile("secrets_frozen.conf")
+	assertNoError(t, err)
+
+	data, err := os.ReadFile("secrets_frozen.conf")
+	assertNoError(t, err)
+	if !strings.Contains(string(data), `database.password = "hunter2"`) {
+		t.Errorf("Expected WriteFile to keep secret values, got\n%s", data)
+	}
+}
+
+func TestIncludeFS(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	SetIncludeFS(fstest.MapFS{
+		"overlay_base.conf":      {Data: []byte(`test.overlay.base = "virtual"`)},
+		"overlay.d/one.conf":     {Data: []byte(`test.overlay.one = "1"`)},
+		"overlay.d/two.conf":     {Data: []byte(`test.overlay.two = "2"`)},
+		"overlay_glob/a.conf":    {Data: []byte(`test.overlay.glob = "a"`)},
+		"overlay_data/data.json": {Data: []byte(`{"test": {"overlay": {"json": "yes"}}}`)},
+	})
+
+	createTempConfig(t, "overlay_disk.conf", `test.overlay.disk = "real"`)
+	createTempConfig(t, "overlay_main.conf", `
+include "overlay_base.conf"
+include "overlay_disk.conf"
+include directory("overlay.d")
+include "overlay_glob/*.conf"
+include json("overlay_data/data.json")
+`)
+
+	err := Load("overlay_main.conf")
+	assertNoError(t, err)
+
+	assertEnvVar(t, "test.overlay.base", "virtual")
+	assertEnvVar(t, "test.overlay.disk", "real")
+	assertEnvVar(t, "test.overlay.one", "1")
+	assertEnvVar(t, "test.overlay.two", "2")
+	assertEnvVar(t, "test.overlay.glob", "a")
+	assertEnvVar(t, "test.overlay.json", "yes")
+}
+
+func TestIncludeURLPolicy(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`test.policy.remote = "fetched"`))
+	}))
+	defer server.Close()
+
+	createTempConfig(t, "policy_required.conf", `include url("`+server.URL+`")`)
+	createTempConfig(t, "policy_optional.conf", `
+include optional url("`+server.URL+`")
+test.policy.local = "kept"
+`)
+
+	SetIncludeHostAllowlist([]string{"config.example.com"})
+	if err := Load("policy_required.conf"); err == nil || !strings.Contains(err.Error(), "allowlist") {
+		t.Errorf("expected allowlist error, got %v", err)
+	}
+
+	err := Load("policy_optional.conf")
+	assertNoError(t, err)
+	assertEnvVar(t, "test.policy.local", "kept")
+	if _, ok := os.LookupEnv("test.policy.remote"); ok {
+		t.Error("expected disallowed optional include to be skipped")
+	}
+
+	Reset()
+	SetIncludeHostAllowlist([]string{"127.0.0.1"})
+	SetBlockPrivateIncludes(true)
+	if err := Load("policy_required.conf"); err == nil || !strings.Contains(err.Error(), "blocked") {
+		t.Errorf("expected loopback connection to be blocked, got %v", err)
+	}
+
+	Reset()
+	SetIncludeHostAllowlist([]string{"127.0.0.1"})
+	err = Load("policy_required.conf")
+	assertNoError(t, err)
+	assertEnvVar(t, "test.policy.remote", "fetched")
+
+	// Carrier-grade NAT addresses are internal too
+	SetBlockPrivateIncludes(true)
+	if err := checkDialAddress("tcp", "100.64.1.2:443", nil); err == nil {
+		t.Error("expected a carrier-grade NAT address to be blocked")
+	}
+	if err := checkDialAddress("tcp", "100.128.0.1:443", nil); err != nil {
+		t.Errorf("expected an address outside 100.64.0.0/10 to be allowed, got %v", err)
+	}
+
+	// A proxy would be checked instead of the target, so none is used while blocking
+	req, _ := http.NewRequest(http.MethodGet, "https://config.example.com/app.conf", nil)
+	if proxy, err := includeProxy(req); proxy != nil || err != nil {
+		t.Errorf("expected no proxy while private includes are blocked, got %v, %v", proxy, err)
+	}
+}
+
+func TestIncludeFirst(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`test.first.remote = "url"`))
+	}))
+	defer server.Close()
+
+	createTempConfig(t, "first_shared.conf", `test.first.source = "shared"`)
+	createTempConfig(t, "first_other.conf", `test.first.other = "loaded"`)
+	createTempConfig(t, "first.conf", `
+include first("first_local.conf", "first_shared.conf", "first_other.conf")
+include first("first_missing.conf", url("`+server.URL+`"))
+include optional first("first_none.conf", "first_nothing.conf")
+`)
+
+	err := Load("first.conf")
+	assertNoError(t, err)
+	assertEnvVar(t, "test.first.source", "shared")
+	assertEnvVar(t, "test.first.remote", "url")
+	if _, ok := os.LookupEnv("test.first.other"); ok {
+		t.Error("expected candidates after the first match to be skipped")
+	}
+
+	createTempConfig(t, "first_required.conf", `include first("first_none.conf", "first_nothing.conf")`)
+	if err := Load("first_required.conf"); err == nil {
+		t.Error("expected error when no candidate of a required first(...) exists")
+	}
+
+	// A candidate that fails to parse fails the include instead of falling through
+	createTempConfig(t, "first_broken.conf", "pa.x = 1\npa.y {\n")
+	createTempConfig(t, "first_fallback.conf", `pa.z = 3`)
+	createTempConfig(t, "first_parse.conf", `include first("first_broken.conf", "first_fallback.conf")`)
+	if err := Load("first_parse.conf"); !errors.Is(err, ErrSyntax) {
+		t.Errorf("expected a syntax error from the broken candidate, got %v", err)
+	}
+	if _, ok := lookupValue("pa.x"); ok {
+		t.Error("expected nothing from the broken candidate to be kept")
+	}
+	if _, ok := lookupValue("pa.z"); ok {
+		t.Error("expected the next candidate not to be loaded after a syntax error")
+	}
+
+	// A candidate that turns out to be missing part of its files is rolled back
+	createTempConfig(t, "first_partial.conf", "pb.x = 1\ninclude required(\"first_gone.conf\")\n")
+	createTempConfig(t, "first_rollback.conf", `include first("first_partial.conf", "first_fallback.conf")`)
+	err = Load("first_rollback.conf")
+	assertNoError(t, err)
+	assertEnvVar(t, "pa.z", "3")
+	if _, ok := lookupValue("pb.x"); ok {
+		t.Error("expected the keys of the unavailable candidate to be rolled back")
+	}
+}
+
+func TestGetAll(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	t.Setenv("HOCONENV_TEST_LISTENER", ":9090")
+
+	createTempConfig(t, "history_base.conf", `
+listener = ":8080"
+listener = ":8081"
+`)
+	createTempConfig(t, "history_main.conf", `
+include "history_base.conf"
+listener = ${HOCONENV_TEST_LISTENER}
+listener = ":8443"
+single = "one"
+`)
+
+	SetTrackHistory(true)
+
+	err := Load("history_main.conf")
+	assertNoError(t, err)
+	assertEnvVar(t, "listener", ":8443")
+
+	expected := []string{":8080", ":8081", ":9090", ":8443"}
+	if got := GetAll("listener"); !reflect.DeepEqual(got, expected) {
+		t.Errorf("GetAll(listener) = %v; want %v", got, expected)
+	}
+	if got := GetAll("single"); !reflect.DeepEqual(got, []string{"one"}) {
+		t.Errorf("GetAll(single) = %v; want [one]", got)
+	}
+	if got := GetAll("missing"); got != nil {
+		t.Errorf("GetAll(missing) = %v; want nil", got)
+	}
+}
+
+func TestCheckResolved(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "resolved.conf", `
+app.host = "localhost"
+app.url = "http://"${app.host}
+app.literal = "${not.a.reference}"
+app.optional = ${?HOCONENV_TEST_UNDEFINED}
+app.partial = prefix-${?HOCONENV_TEST_UNDEFINED}
+`)
+
+	err := Load("resolved.conf")
+	assertNoError(t, err)
+	assertNoError(t, CheckResolved())
+
+	createTempConfig(t, "unresolved.conf", `
+app.broken = ${app.hots}
+app.fixed = ${app.missing}
+app.fixed = "ok"
+app.multi = ${first.typo}-${second.typo}
+`)
+
+	err = Load("unresolved.conf")
+	assertNoError(t, err)
+
+	err = CheckResolved()
+	expected := "unresolved substitutions: app.broken (${app.hots}), app.multi (${first.typo}, ${second.typo})"
+	if err == nil || err.Error() != expected {
+		t.Errorf("CheckResolved() = %v; want %s", err, expected)
+	}
+}
+
+func TestLoadWithData(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "template.conf", `
+app.name = "demo"
+app.greeting = "Hello {{.User}}"
+app.banner = ${app.name}" for {{.User}} on {{.Region}}"
+app.plain = "no template"
+`)
+
+	err := LoadWithData(map[string]any{"User": "ana", "Region": "eu"}, "template.conf")
+	assertNoError(t, err)
+
+	assertEnvVar(t, "app.greeting", "Hello ana")
+	assertEnvVar(t, "app.banner", "demo for ana on eu")
+	assertEnvVar(t, "app.plain", "no template")
+
+	Reset()
+	createTempConfig(t, "template_missing.conf", `app.missing = "{{.Unknown}}"`)
+
+	err = LoadWithData(map[string]any{}, "template_missing.conf")
+	if err == nil || !strings.Contains(err.Error(), "app.missing") {
+		t.Errorf("expected error referencing app.missing, got %v", err)
+	}
+
+	// The data only applies to its own load, not to a load running at the same time. The other
+	// load fails before rendering, so only a leaked use of its data could render app.literal
+	createTempConfig(t, "template_broken.conf", "app.other {\n")
+	loadDuring(t, func(url string) error {
+		createTempConfig(t, "template_plain.conf", fmt.Sprintf("include url(\"%s\")\napp.literal = \"{{.User}}\"\n", url))
+		return Load("template_plain.conf")
+	}, func() error {
+		if err := LoadWithData(map[string]any{"User": "ana"}, "template_broken.conf"); !errors.Is(err, ErrSyntax) {
+			return fmt.Errorf("expected a syntax error, got %v", err)
+		}
+		return nil
+	})
+
+	assertEnvVar(t, "app.literal", "{{.User}}")
+}
+
+func TestLoadByExtension(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "ext.json", `{"test": {"ext": {"json": "from-json"}}}`)
+	createTempConfig(t, "ext.properties", "test.ext.properties: from-properties\n")
+	createTempConfig(t, "ext.hocon", `
+test.ext {
+	hocon = "from-hocon"
+}
+`)
+	createTempConfig(t, "ext.cfg", `test.ext.unknown = "as-hocon"`)
+
+	err := Load("ext.json", "ext.properties", "ext.hocon", "ext.cfg")
+	assertNoError(t, err)
+
+	assertEnvVar(t, "test.ext.json", "from-json")
+	assertEnvVar(t, "test.ext.properties", "from-properties")
+	assertEnvVar(t, "test.ext.hocon", "from-hocon")
+	assertEnvVar(t, "test.ext.unknown", "as-hocon")
+}
+
+func TestWarningsAsErrors(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "warnings.conf", `
+include optional "warnings_missing.conf"
+test.warnings.value = ${test.warnings.typo}
+`)
+
+	err := Load("warnings.conf")
+	assertNoError(t, err)
+
+	expected := []string{
+		"Optional include file not found: warnings_missing.conf",
+		"Unresolved substitution in test.warnings.value: ${test.warnings.typo}",
+	}
+	if got := Warnings(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Warnings() = %q; want %q", got, expected)
+	}
+
+	Reset()
+	SetWarningsAsErrors(true)
+
+	createTempConfig(t, "warnings_strict.conf", `
+include optional "warnings_missing.conf"
+test.warnings.strict = ${test.warnings.typo}
+`)
+
+	err = Load("warnings_strict.conf")
+	if err == nil || !strings.Contains(err.Error(), "2 warning(s)") {
+		t.Fatalf("expected aggregated warnings error, got %v", err)
+	}
+	if _, ok := os.LookupEnv("test.warnings.strict"); ok {
+		t.Error("expected nothing to be applied when warnings fail the load")
+	}
+
+	createTempConfig(t, "warnings_clean.conf", `test.warnings.clean = "yes"`)
+	err = Load("warnings_clean.conf")
+	assertNoError(t, err)
+	assertEnvVar(t, "test.warnings.clean", "yes")
+}
+
+func TestGlobBase(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "globbase/parts/a.conf", `test.globbase.source = "file-relative"`)
+	createTempConfig(t, "parts/a.conf", `test.globbase.source = "cwd-relative"`)
+	createTempConfig(t, "globbase/main.conf", `include "parts/*.conf"`)
+	createTempConfig(t, "globbase/prefixed.conf", `include "cwd:parts/*.conf"`)
+
+	err := Load("globbase/main.conf")
+	assertNoError(t, err)
+	assertEnvVar(t, "test.globbase.source", "file-relative")
+
+	Reset()
+	err = Load("globbase/prefixed.conf")
+	assertNoError(t, err)
+	assertEnvVar(t, "test.globbase.source", "cwd-relative")
+
+	Reset()
+	SetGlobBase(GlobBaseCwd)
+	err = Load("globbase/main.conf")
+	assertNoError(t, err)
+	assertEnvVar(t, "test.globbase.source", "cwd-relative")
+}
+
+func TestOverride(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "override.conf", `test.override.host = "localhost"`)
+
+	err := Load("override.conf")
+	assertNoError(t, err)
+
+	restoreHost := Override("test.override.host", "db.internal")
+	restoreNew := Override("test.override.fresh", "new")
+
+	if got := GetDefaultValue("test.override.host", ""); got != "db.internal" {
+		t.Errorf("Expected overridden value, got %q", got)
+	}
+	assertEnvVar(t, "test.override.host", "db.internal")
+	assertEnvVar(t, "test.override.fresh", "new")
+
+	restoreNew()
+	restoreHost()
+	restoreHost()
+
+	if got := GetDefaultValue("test.override.host", ""); got != "localhost" {
+		t.Errorf("Expected restored value, got %q", got)
+	}
+	assertEnvVar(t, "test.override.host", "localhost")
+
+	if got := GetDefaultValue("test.override.fresh", "unset"); got != "unset" {
+		t.Errorf("Expected override of unset key to be removed, got %q", got)
+	}
+	if _, ok := os.LookupEnv("test.override.fresh"); ok {
+		t.Error("Expected env var of unset key to be removed")
+	}
+
+	// A new key given with the prefix is stored without it
+	SetPrefix("prod")
+	restorePrefixed := Override("prod.test.override.NewKey", "v")
+	defer restorePrefixed()
+
+	assertEnvVar(t, "prod.test.override.newkey", "v")
+	if _, ok := os.LookupEnv("prod.prod.test.override.newkey"); ok {
+		t.Error("Expected the prefix not to be applied twice")
+	}
+	if got := GetDefaultValue("test.override.newkey", ""); got != "v" {
+		t.Errorf("Expected prefixed override to be stored without the prefix, got %q", got)
+	}
+}
+
+func TestIncludeURLErrors(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/syntax.conf":
+			w.Write([]byte("# remote config\nremote.ok = 1\n\nthis line is broken\n"))
+		case "/unclosed.conf":
+			w.Write([]byte("remote {\n  key = value\n"))
+		}
+	}))
+	defer server.Close()
+
+	createTempConfig(t, "url_syntax.conf", `include url("`+server.URL+`/syntax.conf")`)
+	createTempConfig(t, "url_unclosed.conf", `include url("`+server.URL+`/unclosed.conf")`)
+
+	err := Load("url_syntax.conf")
+	expected := "invalid syntax at " + server.URL + "/syntax.conf:4"
+	if err == nil || !strings.Contains(err.Error(), expected) {
+		t.Errorf("expected error containing %q, got %v", expected, err)
+	}
+
+	err = Load("url_unclosed.conf")
+	if err == nil || !strings.Contains(err.Error(), "unclosed block 'remote' in "+server.URL) {
+		t.Errorf("expected unclosed block error, got %v", err)
+	}
+}
+
+func TestLoadReader(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	SetTrackOrigins(true)
+
+	err := LoadReader(strings.NewReader("reader {\n  value = \"streamed\"\n}\n"), "stdin.conf")
+	assertNoError(t, err)
+	assertEnvVar(t, "reader.value", "streamed")
+
+	if got := Origin("reader.value"); got != "stdin.conf:2" {
+		t.Errorf("Origin(reader.value) = %q; want %q", got, "stdin.conf:2")
+	}
+}
+
+func TestApplyOrder(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "apply_order.conf", `
+Test.Apply.Url = "upper"
+test.apply.url = "lower"
+TEST.APPLY.URL = "shout"
+`)
+
+	// Sorted order applies TEST.APPLY.URL, Test.Apply.Url and then test.apply.url
+	for i := 0; i < 5; i++ {
+		Reset()
+		err := Load("apply_order.conf")
+		assertNoError(t, err)
+		assertEnvVar(t, "test.apply.url", "lower")
+	}
+}
+
+func TestEnvCollision(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "collision.conf", `
+Test.Collision.Url = "first"
+test.collision.url = "second"
+test.collision.other = "fine"
+`)
+
+	err := Load("collision.conf")
+	assertNoError(t, err)
+	assertEnvVar(t, "test.collision.url", "second")
+
+	expected := []string{"Config keys Test.Collision.Url and test.collision.url both map to environment variable test.collision.url, using the value of test.collision.url"}
+	if got := Warnings(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Warnings() = %q; want %q", got, expected)
+	}
+
+	Reset()
+	SetWarningsAsErrors(true)
+
+	err = Load("collision.conf")
+	if err == nil || !strings.Contains(err.Error(), "Test.Collision.Url and test.collision.url") {
+		t.Errorf("expected collision error under strict mode, got %v", err)
+	}
+}
+
+func TestLoadInto(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	type Database struct {
+		Host    string `hocon:"host,required"`
+		Port    int    `hocon:"port"`
+		Replica *bool  `hocon:"replica"`
+	}
+
+	type Config struct {
+		Name     string   `hocon:"app.name"`
+		Ratio    float64  `hocon:"app.ratio"`
+		Workers  uint8    `hocon:"app.workers"`
+		Database Database `hocon:"database"`
+		Ignored  string   `hocon:"-"`
+		Debug    bool
+		internal string
+	}
+
+	createTempConfig(t, "into.conf", `
+app {
+	name = "demo"
+	ratio = .75
+	workers = 8
+}
+database {
+	host = "localhost"
+	port = 5432
+	replica = true
+}
+debug = true
+ignored = "nope"
+`)
+
+	var cfg Config
+	err := LoadInto(&cfg, "into.conf")
+	assertNoError(t, err)
+
+	replica := true
+	expected := Config{
+		Name:     "demo",
+		Ratio:    0.75,
+		Workers:  8,
+		Database: Database{Host: "localhost", Port: 5432, Replica: &replica},
+		Debug:    true,
+	}
+	if !reflect.DeepEqual(cfg, expected) {
+		t.Errorf("LoadInto() = %+v; want %+v", cfg, expected)
+	}
+
+	createTempConfig(t, "into_invalid.conf", `database.port = "not-a-port"`)
+	err = LoadInto(&cfg, "into_invalid.conf")
+	var fieldErr *FieldError
+	if !errors.As(err, &fieldErr) || fieldErr.Field != "Database.Port" || fieldErr.Value != "not-a-port" {
+		t.Errorf("expected FieldError for Database.Port, got %v", err)
+	}
+
+	Reset()
+	var missing struct {
+		Database Database `hocon:"database"`
+	}
+	createTempConfig(t, "into_missing.conf", `database.port = 1`)
+	err = LoadInto(&missing, "into_missing.conf")
+	if !errors.Is(err, ErrMissingKey) || !strings.Contains(err.Error(), "database.host") {
+		t.Errorf("expected missing key error for database.host, got %v", err)
+	}
+
+	if err := LoadInto(&missing, "into_absent.conf"); err == nil || errors.As(err, &fieldErr) {
+		t.Errorf("expected plain load error, got %v", err)
+	}
+}
+
+func TestIncludeHint(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "hint_db.conf", `test.hint.db = "ok"`)
+	createTempConfig(t, "hint_present.conf", `include required "hint_db.conf" or "run scripts/gen-config.sh first"`)
+	createTempConfig(t, "hint_missing.conf", `include required "hint_generated.conf" or "run scripts/gen-config.sh first"`)
+	createTempConfig(t, "hint_plain.conf", `include "hint or nothing.conf"`)
+
+	err := Load("hint_present.conf")
+	assertNoError(t, err)
+	assertEnvVar(t, "test.hint.db", "ok")
+
+	err = Load("hint_missing.conf")
+	if err == nil || !strings.HasSuffix(err.Error(), "(hint: run scripts/gen-config.sh first)") {
+		t.Errorf("expected error with hint, got %v", err)
+	}
+
+	err = Load("hint_plain.conf")
+	if err == nil || strings.Contains(err.Error(), "hint:") || !strings.Contains(err.Error(), "hint or nothing.conf") {
+		t.Errorf("expected plain error for quoted file name, got %v", err)
+	}
+}
+
+func TestUnusedKeys(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "usage.conf", `
+app.name = "demo"
+app.timeout = 5s
+app.legacy = "dead"
+db {
+	host = "localhost"
+	port = 5432
+}
+`)
+
+	SetPrefix("usage")
+	err := Load("usage.conf")
+	assertNoError(t, err)
+
+	if got := UnusedKeys(); got != nil {
+		t.Errorf("UnusedKeys() without tracking = %v; want nil", got)
+	}
+
+	SetTrackUsage(true)
+
+	GetDefaultValue("usage.app.name", "")
+	GetDuration("app.timeout", 0)
+	if _, err := GetJSON("db"); err != nil {
+		t.Fatal(err)
+	}
+	GetDefaultValue("app.missing", "")
+
+	expected := []string{"app.legacy"}
+	if got := UnusedKeys(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("UnusedKeys() = %v; want %v", got, expected)
+	}
+}
+
+func TestImportEnv(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	if err := ImportEnv(); err == nil {
+		t.Error("expected ImportEnv without a prefix to fail")
+	}
+
+	SetPrefix("hoconenvimport")
+	t.Setenv("hoconenvimport.database.url", "postgres://env")
+	t.Setenv("hoconenvimport.database.user", "env-user")
+
+	if got := EnvName("database.url"); got != "hoconenvimport.database.url" {
+		t.Errorf("EnvName(database.url) = %q", got)
+	}
+
+	createTempConfig(t, "import.conf", `
+database.user = "file-user"
+database.dsn = ${database.url}"?user="${database.user}
+`)
+
+	err := ImportEnv()
+	assertNoError(t, err)
+
+	err = Load("import.conf")
+	assertNoError(t, err)
+
+	assertEnvVar(t, "hoconenvimport.database.url", "postgres://env")
+	assertEnvVar(t, "hoconenvimport.database.user", "file-user")
+	assertEnvVar(t, "hoconenvimport.database.dsn", "postgres://env?user=file-user")
+
+	// Upper-snake names are imported as dotted lowercase keys
+	Reset()
+	SetPrefix("prod.")
+	t.Setenv("PROD_DATABASE_URL", "postgres://snake")
+
+	err = ImportEnv()
+	assertNoError(t, err)
+
+	if got := GetDefaultValue("database.url", ""); got != "postgres://snake" {
+		t.Errorf("Expected PROD_DATABASE_URL to be imported as database.url, got %q", got)
+	}
+}
+
+func TestRawKeysAcrossLoads(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "raw_first.conf", `Raw.First = "one"`)
+	createTempConfig(t, "raw_second.conf", `
+raw.second = "two"
+combined = ${raw.first}"+"${raw.second}
+`)
+
+	SetPrefix("rawkeys")
+
+	err := Load("raw_first.conf")
+	assertNoError(t, err)
+	err = Load("raw_second.conf")
+	assertNoError(t, err)
+
+	assertEnvVar(t, "rawkeys.raw.first", "one")
+	assertEnvVar(t, "rawkeys.raw.second", "two")
+	assertEnvVar(t, "rawkeys.combined", "one+two")
+	if _, ok := os.LookupEnv("rawkeys.rawkeys.raw.first"); ok {
+		t.Error("expected keys from an earlier load not to be prefixed twice")
+	}
+
+	for _, key := range []string{"raw.first", "Raw.First", "rawkeys.raw.first"} {
+		if got := GetDefaultValue(key, ""); got != "one" {
+			t.Errorf("GetDefaultValue(%s) = %q; want %q", key, got, "one")
+		}
+	}
+
+	var keys []string
+	Range(func(key, value string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	expected := []string{"rawkeys.combined", "rawkeys.raw.first", "rawkeys.raw.second"}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Range keys = %v; want %v", keys, expected)
+	}
+}
+
+func TestAnnotations(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "annotations.conf", `
+# Connection settings
+# @since 2.0
+database {
+	# @deprecated use database.uri
+	// @owner	platform-team
+	url = "postgres://localhost"
+
+	# @since 2.1
+	uri = "postgres://localhost"
+	pool = 10
+}
+# An ordinary comment
+plain = "value"
+`)
+
+	err := Load("annotations.conf")
+	assertNoError(t, err)
+	if got := Annotations("database.url"); got != nil {
+		t.Errorf("expected no annotations without SetParseAnnotations, got %v", got)
+	}
+
+	Reset()
+	SetParseAnnotations(true)
+	err = Load("annotations.conf")
+	assertNoError(t, err)
+
+	tests := map[string]map[string]string{
+		"database":      {"since": "2.0"},
+		"database.url":  {"deprecated": "use database.uri", "owner": "platform-team"},
+		"DATABASE.URI":  {"since": "2.1"},
+		"database.pool": nil,
+		"plain":         nil,
+	}
+	for key, expected := range tests {
+		if got := Annotations(key); !reflect.DeepEqual(got, expected) {
+			t.Errorf("Annotations(%s) = %v; want %v", key, got, expected)
+		}
+	}
+}
+
+func TestLoadFragment(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "fragment_extra.conf", `test.fragment.extra = "included"`)
+	createTempConfig(t, "fragments.conf", `
+test.fragment.outside = "skipped"
+
+fragment "cache" {
+	test.fragment.cache {
+		ttl = 60
+	}
+	include "fragment_extra.conf"
+}
+
+fragment "queue" {
+	test.fragment.queue.size = 100
+}
+
+fragment "search" {
+	test.fragment.search.url = "http://search"
+}
+`)
+
+	err := LoadFragments([]string{"cache", "queue"}, "fragments.conf")
+	assertNoError(t, err)
+
+	assertEnvVar(t, "test.fragment.cache.ttl", "60")
+	assertEnvVar(t, "test.fragment.extra", "included")
+	assertEnvVar(t, "test.fragment.queue.size", "100")
+	for _, key := range []string{"test.fragment.outside", "test.fragment.search.url"} {
+		if _, ok := os.LookupEnv(key); ok {
+			t.Errorf("expected %s to be skipped", key)
+		}
+	}
+
+	Reset()
+	err = Load("fragments.conf")
+	assertNoError(t, err)
+	assertEnvVar(t, "test.fragment.outside", "skipped")
+	if got := GetDefaultValue("test.fragment.search.url", "none"); got != "none" {
+		t.Errorf("expected fragments to be skipped by Load, got %q", got)
+	}
+
+	Reset()
+	err = LoadFragment("search", "fragments.conf")
+	assertNoError(t, err)
+	assertEnvVar(t, "test.fragment.search.url", "http://search")
+
+	// The fragments only apply to their own load, not to a load running at the same time
+	createTempConfig(t, "fragments_other.conf", "fragment \"search\" {\n    test.fragment.other = \"loaded\"\n}\n")
+	loadDuring(t, func(url string) error {
+		createTempConfig(t, "fragments_plain.conf", fmt.Sprintf("include url(\"%s\")\ntest.fragment.plain = \"kept\"\n", url))
+		return Load("fragments_plain.conf")
+	}, func() error {
+		return LoadFragment("search", "fragments_other.conf")
+	})
+
+	assertEnvVar(t, "test.fragment.plain", "kept")
+	assertEnvVar(t, "test.fragment.other", "loaded")
+}
+
+func TestAtomicLoad(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "atomic_base.conf", `test.atomic.value = "base"`)
+	createTempConfig(t, "atomic_first.conf", `
+test.atomic.value = "first"
+test.atomic.first = "yes"
+`)
+	createTempConfig(t, "atomic_broken.conf", `
+test.atomic.broken = "partial"
+this line is not valid
+`)
+
+	err := Load("atomic_base.conf")
+	assertNoError(t, err)
+
+	err = Load("atomic_first.conf", "atomic_broken.conf")
+	if err == nil {
+		t.Fatal("expected syntax error")
+	}
+
+	assertEnvVar(t, "test.atomic.value", "base")
+	if got := GetDefaultValue("test.atomic.value", ""); got != "base" {
+		t.Errorf("Expected value to be rolled back to base, got %q", got)
+	}
+	for _, key := range []string{"test.atomic.first", "test.atomic.broken"} {
+		if got := GetDefaultValue(key, "unset"); got != "unset" {
+			t.Errorf("Expected %s to be rolled back, got %q", key, got)
+		}
+		if _, ok := os.LookupEnv(key); ok {
+			t.Errorf("Expected %s not to be applied", key)
+		}
+	}
+	if graph := IncludeGraph(); len(graph) != 0 {
+		t.Errorf("Expected include graph to be rolled back, got %v", graph)
+	}
+
+	// Files from the failed load can be loaded again once fixed
+	err = Load("atomic_first.conf")
+	assertNoError(t, err)
+	assertEnvVar(t, "test.atomic.first", "yes")
+
+	// A failed load running at the same time doesn't roll back a successful one
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("atomic_concurrent_%d.conf", i)
+		createTempConfig(t, name, fmt.Sprintf("test.atomic.concurrent.k%d = %d", i, i))
+
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := Load(name); err != nil {
+				t.Errorf("Load(%s) failed: %v", name, err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			Load("atomic_broken.conf")
+		}()
+	}
+	wg.Wait()
+
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("test.atomic.concurrent.k%d", i)
+		if got := GetDefaultValue(key, "unset"); got != fmt.Sprint(i) {
+			t.Errorf("Expected %s to survive concurrent failed loads, got %q", key, got)
+		}
+	}
+}
+
+func TestSubstitutionFunctions(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	os.Setenv("TEST_FUNC_REGION", "eu-west")
+	defer os.Unsetenv("TEST_FUNC_REGION")
+
+	createTempConfig(t, "functions.conf", `
+test.func.logfile = "app-"${date("2006-01-02")}".log"
+test.func.region = ${env("TEST_FUNC_REGION")}
+test.func.missing = ${?env("TEST_FUNC_UNSET")}
+test.func.id = ${uuid()}
+`)
+
+	err := Load("functions.conf")
+	assertNoError(t, err)
+
+	assertEnvVar(t, "test.func.logfile", "app-"+time.Now().Format("2006-01-02")+".log")
+	assertEnvVar(t, "test.func.region", "eu-west")
+	if got := GetDefaultValue("test.func.missing", "unset"); got != "unset" {
+		t.Errorf("Expected undefined env() to leave key unset, got %q", got)
+	}
+
+	id := os.Getenv("test.func.id")
+	if len(id) != 36 || id[14] != '4' {
+		t.Errorf("Expected a version 4 UUID, got %q", id)
+	}
+
+	createTempConfig(t, "functions_unknown.conf", `test.func.bad = ${nope("x")}`)
+	err = Load("functions_unknown.conf")
+	if err == nil || !strings.Contains(err.Error(), "unknown function nope()") {
+		t.Errorf("Expected unknown function error, got %v", err)
+	}
+
+	createTempConfig(t, "functions_arity.conf", `test.func.arity = ${date()}`)
+	err = Load("functions_arity.conf")
+	if err == nil || !strings.Contains(err.Error(), "takes 1 argument(s), got 0") {
+		t.Errorf("Expected argument count error, got %v", err)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "decode.conf", `
+test.decode {
+    name = "svc"
+    port = "abc"
+    ratio = "high"
+}
+`)
+
+	err := Load("decode.conf")
+	assertNoError(t, err)
+
+	var cfg struct {
+		Name     string  `hocon:"test.decode.name"`
+		Port     int     `hocon:"test.decode.port"`
+		Ratio    float64 `hocon:"test.decode.ratio"`
+		Token    string  `hocon:"test.decode.token,required"`
+		Optional string  `hocon:"test.decode.optional"`
+	}
+
+	errs := Decode(&cfg)
+	if len(errs) != 3 {
+		t.Fatalf("Expected 3 errors, got %d: %v", len(errs), errs)
+	}
+
+	var fieldErr *FieldError
+	if !errors.As(errs[0], &fieldErr) || fieldErr.Field != "Port" || fieldErr.Value != "abc" {
+		t.Errorf("Expected Port conversion error first, got %v", errs[0])
+	}
+	if !errors.As(errs[1], &fieldErr) || fieldErr.Field != "Ratio" {
+		t.Errorf("Expected Ratio conversion error second, got %v", errs[1])
+	}
+	if !errors.Is(errs[2], ErrMissingKey) {
+		t.Errorf("Expected missing required key error last, got %v", errs[2])
+	}
+	if cfg.Name != "svc" {
+		t.Errorf("Expected valid fields to be populated, got %q", cfg.Name)
+	}
+
+	var ok struct {
+		Name string `hocon:"test.decode.name,required"`
+	}
+	if errs := Decode(&ok); errs != nil {
+		t.Errorf("Expected no errors, got %v", errs)
+	}
+}
+
+func TestIsEnabled(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "flags.conf", `
+test.flag {
+    a = true
+    b = yes
+    c = ON
+    d = 1
+    e = enabled
+    f = false
+    g = no
+    h = "maybe"
+}
+`)
+
+	SetPrefix("app")
+	err := Load("flags.conf")
+	assertNoError(t, err)
+
+	for _, key := range []string{"test.flag.a", "test.flag.b", "test.flag.c", "test.flag.d", "test.flag.e"} {
+		if !IsEnabled(key) {
+			t.Errorf("Expected %s to be enabled", key)
+		}
+	}
+	for _, key := range []string{"test.flag.f", "test.flag.g", "test.flag.h", "test.flag.unset"} {
+		if IsEnabled(key) {
+			t.Errorf("Expected %s to be disabled", key)
+		}
+	}
+
+	if !IsEnabled("app.test.flag.a") {
+		t.Error("Expected prefixed key to be enabled")
+	}
+}
+
+func TestIncludeAlways(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "always_tmpl.conf", `test.always.mode = "template"`)
+	createTempConfig(t, "always_once.conf", `
+include "always_tmpl.conf"
+test.always.mode = "custom"
+include "always_tmpl.conf"
+`)
+	createTempConfig(t, "always_again.conf", `
+include "always_tmpl.conf"
+test.always.again = "custom"
+test.always.mode = "custom"
+include always "always_tmpl.conf"
+`)
+
+	err := Load("always_once.conf")
+	assertNoError(t, err)
+	assertEnvVar(t, "test.always.mode", "custom")
+
+	err = Load("always_again.conf")
+	assertNoError(t, err)
+	assertEnvVar(t, "test.always.mode", "template")
+
+	Reset()
+	createTempConfig(t, "always_cycle.conf", `include always "always_cycle.conf"`)
+	err = Load("always_cycle.conf")
+	if err == nil || !strings.Contains(err.Error(), "include cycle") {
+		t.Errorf("Expected include cycle error, got %v", err)
+	}
+}
+
+func TestMultilineQuotedValue(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "multiline.conf", `
+test.multiline {
+    cert = "-----BEGIN CERT-----
+  abc def
+-----END CERT-----"
+    after = "next" # a "quoted" comment
+}
+`)
+
+	err := Load("multiline.conf")
+	assertNoError(t, err)
+
+	assertEnvVar(t, "test.multiline.cert", "-----BEGIN CERT-----\n  abc def\n-----END CERT-----")
+	assertEnvVar(t, "test.multiline.after", "next")
+
+	createTempConfig(t, "multiline_open.conf", `test.multiline.open = "never closed`)
+	err = Load("multiline_open.conf")
+	if err == nil || !strings.Contains(err.Error(), "unterminated quoted value") {
+		t.Errorf("Expected unterminated quote error, got %v", err)
+	}
+
+	// Escaped quotes and stray quotes in unquoted values don't open a multi-line value
+	Reset()
+	createTempConfig(t, "multiline_escaped.conf", `
+test.multiline.escaped = "he said \"hi"
+test.multiline.stray = say "hi
+test.multiline.b = "x"
+test.multiline.c = "y"
+`)
+	err = Load("multiline_escaped.conf")
+	assertNoError(t, err)
+
+	assertEnvVar(t, "test.multiline.escaped", `he said \"hi`)
+	assertEnvVar(t, "test.multiline.stray", `say "hi`)
+	assertEnvVar(t, "test.multiline.b", "x")
+	assertEnvVar(t, "test.multiline.c", "y")
+}
+
+func TestFingerprint(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "fp_a.conf", `test.fp.a = "1"`)
+	createTempConfig(t, "fp_b.conf", `test.fp.b = "2"`)
+
+	err := Load("fp_a.conf", "fp_b.conf")
+	assertNoError(t, err)
+	first := Fingerprint()
+	if len(first) != 64 {
+		t.Fatalf("Expected a SHA-256 hex digest, got %q", first)
+	}
+
+	Reset()
+	err = Load("fp_b.conf", "fp_a.conf")
+	assertNoError(t, err)
+	if got := Fingerprint(); got != first {
+		t.Errorf("Expected fingerprint to ignore file order, got %s and %s", first, got)
+	}
+
+	MarkSecret("test.fp.a")
+	if got := Fingerprint(); got != first {
+		t.Errorf("Expected marking a secret not to change the fingerprint")
+	}
+
+	restore := Override("test.fp.a", "changed")
+	defer restore()
+	if got := Fingerprint(); got == first {
+		t.Error("Expected fingerprint to change with a value")
+	}
+}
+
+func TestEnvNameOverride(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+	defer os.Unsetenv("TEST_ENVNAME_CONN")
+	defer os.Unsetenv("TEST_ENVNAME_CODE")
+
+	createTempConfig(t, "envname.conf", `
+test.envname {
+    # @env TEST_ENVNAME_CONN
+    connection = "postgres://db"
+    other = "plain"
+    code = "x1"
+}
+`)
+
+	SetEnvNameFor("test.envname.code", "TEST_ENVNAME_CODE")
+	err := Load("envname.conf")
+	assertNoError(t, err)
+
+	assertEnvVar(t, "TEST_ENVNAME_CONN", "postgres://db")
+	assertEnvVar(t, "TEST_ENVNAME_CODE", "x1")
+	assertEnvVar(t, "test.envname.other", "plain")
+	if _, ok := os.LookupEnv("test.envname.connection"); ok {
+		t.Error("Expected the derived name not to be set for a renamed key")
+	}
+	if got := EnvName("test.envname.connection"); got != "TEST_ENVNAME_CONN" {
+		t.Errorf("Expected EnvName to report the override, got %q", got)
+	}
+	if got := GetDefaultValue("test.envname.connection", ""); got != "postgres://db" {
+		t.Errorf("Expected the key to keep its value, got %q", got)
+	}
+}
+
+func TestParse(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "stream_inc.conf", `test.stream.included = "yes"`)
+
+	config := `
+test.stream {
+    name = "svc"
+    url = "http://"${test.stream.name}
+    include "stream_inc.conf"
+}
+`
+	var got []string
+	err := Parse(strings.NewReader(config), "stream.conf", func(key, value string) error {
+		got = append(got, key+"="+value)
+		return nil
+	})
+	assertNoError(t, err)
+
+	want := []string{"test.stream.name=svc", `test.stream.url="http://"${test.stream.name}`, "test.stream.included=yes"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	if _, ok := os.LookupEnv("test.stream.name"); ok {
+		t.Error("Expected Parse not to touch the environment")
+	}
+	if got := GetDefaultValue("test.stream.name", "unset"); got != "unset" {
+		t.Errorf("Expected Parse not to store values, got %q", got)
+	}
+
+	// Included files can still be loaded normally afterwards
+	err = Load("stream_inc.conf")
+	assertNoError(t, err)
+	assertEnvVar(t, "test.stream.included", "yes")
+
+	stop := errors.New("stop")
+	calls := 0
+	err = Parse(strings.NewReader(config), "stream.conf", func(key, value string) error {
+		calls++
+		return stop
+	})
+	if !errors.Is(err, stop) || calls != 1 {
+		t.Errorf("Expected the handler error to stop parsing, got %v after %d calls", err, calls)
+	}
+
+	// A load running during Parse keeps its keys and doesn't reach the handler
+	createTempConfig(t, "stream_other.conf", `test.stream.other = "loaded"`)
+	var streamed []string
+	err = Parse(strings.NewReader(`test.stream.first = 1`), "stream_side.conf", func(key, value string) error {
+		streamed = append(streamed, key)
+		return Load("stream_other.conf")
+	})
+	assertNoError(t, err)
+
+	if !reflect.DeepEqual(streamed, []string{"test.stream.first"}) {
+		t.Errorf("Expected only the parsed key to be streamed, got %v", streamed)
+	}
+	assertEnvVar(t, "test.stream.other", "loaded")
+	if got := GetDefaultValue("test.stream.other", ""); got != "loaded" {
+		t.Errorf("Expected the concurrent load to be kept, got %q", got)
+	}
+
+	err = Parse(strings.NewReader(`include url("http://localhost/remote.conf")`), "stream_url.conf", func(key, value string) error {
+		return nil
+	})
+	if !errors.Is(err, ErrIncludeFailed) {
+		t.Errorf("Expected URL includes to be rejected by Parse, got %v", err)
+	}
+}
+
+func TestDiscoveryWalkUp(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "application.conf", `test.walkup.found = "root"`)
+	if err := os.MkdirAll(filepath.Join("sub", "deeper"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(filepath.Join("sub", "deeper")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Load(); err == nil {
+		t.Fatal("Expected no default files to be found without walking up")
+	}
+
+	SetDiscoveryWalkUp(true)
+	err := Load()
+	assertNoError(t, err)
+	assertEnvVar(t, "test.walkup.found", "root")
+}
+
+func TestRequireNonEmptyIncludes(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "nonempty_empty.conf", "# only a comment\n")
+	createTempConfig(t, "nonempty_nested.conf", `include "nonempty_leaf.conf"`)
+	createTempConfig(t, "nonempty_leaf.conf", `test.nonempty.leaf = "yes"`)
+	createTempConfig(t, "nonempty_main.conf", `
+include "nonempty_nested.conf"
+include optional "nonempty_empty.conf"
+`)
+	createTempConfig(t, "nonempty_bad.conf", `include "nonempty_empty.conf"`)
+
+	// Empty includes are accepted unless enabled
+	err := Load("nonempty_bad.conf")
+	assertNoError(t, err)
+
+	Reset()
+	SetRequireNonEmptyIncludes(true)
+
+	err = Load("nonempty_main.conf")
+	assertNoError(t, err)
+	assertEnvVar(t, "test.nonempty.leaf", "yes")
+
+	// The optional include above already loaded the empty file, which is then skipped
+	Reset()
+	SetRequireNonEmptyIncludes(true)
+	err = Load("nonempty_bad.conf")
+	if err == nil || !strings.Contains(err.Error(), "nonempty_empty.conf contains no keys") {
+		t.Errorf("Expected empty include error naming the file, got %v", err)
+	}
+}
+
+func TestLoadedFiles(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `test.loadedfiles.remote = "yes"`)
+	}))
+	defer server.Close()
+
+	createTempConfig(t, "lf_child.conf", `test.loadedfiles.child = "yes"`)
+	createTempConfig(t, "lf_main.conf", fmt.Sprintf(`
+include "lf_child.conf"
+include url("%s/remote.conf")
+`, server.URL))
+
+	if files := LoadedFiles(); len(files) != 0 {
+		t.Errorf("Expected no loaded files before Load, got %v", files)
+	}
+
+	err := Load("lf_main.conf")
+	assertNoError(t, err)
+
+	want := []string{server.URL + "/remote.conf", "lf_child.conf", "lf_main.conf"}
+	if got := LoadedFiles(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestPrefixBlock(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "prefixblock_vendor.conf", `
+name = "lib"
+settings {
+    level = 3
+}
+`)
+	createTempConfig(t, "prefixblock.conf", `
+test.prefixblock {
+    prefix "vendor" {
+        include "prefixblock_vendor.conf"
+        local = "here"
+        ref = ${local}
+    }
+    after = "outside"
+}
+`)
+
+	err := Load("prefixblock.conf")
+	assertNoError(t, err)
+
+	assertEnvVar(t, "test.prefixblock.vendor.local", "here")
+	assertEnvVar(t, "test.prefixblock.vendor.ref", "here")
+	assertEnvVar(t, "vendor.name", "lib")
+	assertEnvVar(t, "vendor.settings.level", "3")
+	assertEnvVar(t, "test.prefixblock.after", "outside")
+}
+
+func TestLastModified(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	if !LastModified().IsZero() {
+		t.Fatal("Expected zero time before loading")
+	}
+
+	modified := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Last-Modified", modified.Format(http.TimeFormat))
+		fmt.Fprint(w, `test.mtime.remote = "yes"`)
+	}))
+	defer server.Close()
+
+	createTempConfig(t, "mtime_old.conf", `test.mtime.old = "yes"`)
+	createTempConfig(t, "mtime_new.conf", fmt.Sprintf(`include url("%s/remote.conf")`, server.URL))
+
+	older := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	newer := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	os.Chtimes("mtime_old.conf", older, older)
+	os.Chtimes("mtime_new.conf", newer, newer)
+
+	err := Load("mtime_old.conf")
+	assertNoError(t, err)
+	if got := LastModified(); !got.Equal(older) {
+		t.Errorf("Expected %v, got %v", older, got)
+	}
+
+	err = Load("mtime_new.conf")
+	assertNoError(t, err)
+	if got := LastModified(); !got.Equal(modified) {
+		t.Errorf("Expected the URL Last-Modified %v, got %v", modified, got)
+	}
+}
+
+type testLevel int
+
+func TestRegisterDecoder(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "decoder.conf", `
+test.decoder {
+    timeout = 1d2h
+    endpoint = "https://api.example.com/v1"
+    level = "high"
+    bad = "unknown"
+    ch = "x"
+}
+`)
+
+	err := Load("decoder.conf")
+	assertNoError(t, err)
+
+	RegisterDecoder(reflect.TypeOf(testLevel(0)), func(value string) (interface{}, error) {
+		switch value {
+		case "low":
+			return testLevel(1), nil
+		case "high":
+			return testLevel(2), nil
+		}
+		return nil, fmt.Errorf("unknown level")
+	})
+
+	var cfg struct {
+		Timeout  time.Duration `hocon:"test.decoder.timeout"`
+		Endpoint *url.URL      `hocon:"test.decoder.endpoint"`
+		Level    testLevel     `hocon:"test.decoder.level"`
+	}
+	err = Unmarshal(&cfg)
+	assertNoError(t, err)
+
+	if cfg.Timeout != 26*time.Hour {
+		t.Errorf("Expected 26h, got %v", cfg.Timeout)
+	}
+	if cfg.Endpoint == nil || cfg.Endpoint.Host != "api.example.com" {
+		t.Errorf("Expected parsed URL, got %v", cfg.Endpoint)
+	}
+	if cfg.Level != 2 {
+		t.Errorf("Expected level 2, got %d", cfg.Level)
+	}
+
+	var bad struct {
+		Level testLevel `hocon:"test.decoder.bad"`
+	}
+	var fieldErr *FieldError
+	if err := Unmarshal(&bad); !errors.As(err, &fieldErr) || fieldErr.Field != "Level" {
+		t.Errorf("Expected decoder error for Level, got %v", err)
+	}
+
+	var unsupported struct {
+		Ch chan int `hocon:"test.decoder.ch"`
+	}
+	err = Unmarshal(&unsupported)
+	if err == nil || !strings.Contains(err.Error(), "field Ch") || !strings.Contains(err.Error(), "unsupported type chan int") {
+		t.Errorf("Expected unsupported type error naming field and type, got %v", err)
+	}
+}
+
+func TestErrorOnNoFiles(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "nofiles.conf", `test.nofiles.value = "yes"`)
+
+	err := Load("nofiles.conf")
+	assertNoError(t, err)
+
+	// Loading the same file again reads nothing, which is accepted by default
+	err = Load("nofiles.conf")
+	assertNoError(t, err)
+
+	SetErrorOnNoFiles(true)
+	err = Load("nofiles.conf")
+	if err == nil || !strings.Contains(err.Error(), "no configuration files were loaded") {
+		t.Errorf("Expected no files error, got %v", err)
+	}
+
+	Reset()
+	SetErrorOnNoFiles(true)
+	err = Load("nofiles.conf")
+	assertNoError(t, err)
+}
+
+func TestSubstitutionEscape(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "escape.conf", `
+test.escape {
+    user = "admin"
+    password = pa$${notAVar}ss
+    mixed = $${user}-${test.escape.user}
+    quoted = "${kept}"
+}
+`)
+
+	err := Load("escape.conf")
+	assertNoError(t, err)
+
+	assertEnvVar(t, "test.escape.password", "pa${notAVar}ss")
+	assertEnvVar(t, "test.escape.mixed", "${user}-admin")
+	assertEnvVar(t, "test.escape.quoted", "${kept}")
+
+	if err := CheckResolved(); err != nil {
+		t.Errorf("Expected escaped sequences not to be reported as unresolved, got %v", err)
+	}
+}
+
+func TestLoadDir(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "conf.d/10-base.conf", `test.loaddir.value = "base"
+test.loaddir.base = "yes"`)
+	createTempConfig(t, "conf.d/20-override.conf", `test.loaddir.value = "override"`)
+	createTempConfig(t, "conf.d/30-data.json", `{"test": {"loaddir": {"json": "yes"}}}`)
+	createTempConfig(t, "conf.d/README.md", `this is not config`)
+	createTempConfig(t, "conf.d/nested/40-nested.conf", `test.loaddir.nested = "yes"`)
+
+	err := LoadDir("conf.d")
+	assertNoError(t, err)
+
+	assertEnvVar(t, "test.loaddir.value", "override")
+	assertEnvVar(t, "test.loaddir.base", "yes")
+	assertEnvVar(t, "test.loaddir.json", "yes")
+	if got := GetDefaultValue("test.loaddir.nested", "unset"); got != "unset" {
+		t.Errorf("Expected subdirectories to be skipped, got %q", got)
+	}
+
+	err = LoadDirRecursive("conf.d")
+	assertNoError(t, err)
+	assertEnvVar(t, "test.loaddir.nested", "yes")
+
+	if err := LoadDir("missing.d"); err == nil {
+		t.Error("Expected error for a missing directory")
+	}
+
+	// A directory include loads the same files with the same parsers
+	Reset()
+	createTempConfig(t, "loaddir_include.conf", `include directory("conf.d")`)
+
+	err = Load("loaddir_include.conf")
+	assertNoError(t, err)
+	assertEnvVar(t, "test.loaddir.value", "override")
+	assertEnvVar(t, "test.loaddir.json", "yes")
+}
+
+func TestMaxKeys(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "maxkeys_ok.conf", `
+test.maxkeys.a = 1
+test.maxkeys.a = 2
+test.maxkeys.b = ${test.maxkeys.a}
+test.maxkeys.c = 3
+`)
+	createTempConfig(t, "maxkeys_big.conf", `
+test.maxkeys.d = 4
+`)
+
+	SetMaxKeys(3)
+	err := Load("maxkeys_ok.conf")
+	assertNoError(t, err)
+
+	err = Load("maxkeys_big.conf")
+	if err == nil || !strings.Contains(err.Error(), "maximum of 3 keys") || !strings.Contains(err.Error(), "maxkeys_big.conf:2") {
+		t.Errorf("Expected key limit error naming the file, got %v", err)
+	}
+
+	SetMaxKeys(0)
+	err = Load("maxkeys_big.conf")
+	assertNoError(t, err)
+	assertEnvVar(t, "test.maxkeys.d", "4")
+
+	// JSON and properties files count against the limit too, directly and when included
+	createTempConfig(t, "maxkeys.json", `{"mk": {"a": 1, "b": 2, "c": 3, "d": 4}}`)
+	createTempConfig(t, "maxkeys.properties", "mk.a=1\nmk.b=2\nmk.c=3\n")
+	createTempConfig(t, "maxkeys_json_include.conf", `include json("maxkeys.json")`)
+	createTempConfig(t, "maxkeys_properties_include.conf", `include properties("maxkeys.properties")`)
+
+	for _, file := range []string{"maxkeys.json", "maxkeys.properties", "maxkeys_json_include.conf", "maxkeys_properties_include.conf"} {
+		Reset()
+		SetMaxKeys(2)
+		err = Load(file)
+		if err == nil || !strings.Contains(err.Error(), "maximum of 2 keys") {
+			t.Errorf("Expected key limit error for %s, got %v", file, err)
+		}
+		if _, ok := lookupValue("mk.a"); ok {
+			t.Errorf("Expected nothing from %s to be kept", file)
+		}
+	}
+}
+
+func TestSentinelErrors(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "gone", http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	createTempConfig(t, "sentinel_syntax.conf", "this is not valid\n")
+	createTempConfig(t, "sentinel_include.conf", `include "sentinel_missing.conf"`)
+	createTempConfig(t, "sentinel_url.conf", fmt.Sprintf(`include url("%s/app.conf")`, server.URL))
+
+	tests := []struct {
+		file string
+		want []error
+	}{
+		{"sentinel_none.conf", []error{ErrFileNotFound}},
+		{"sentinel_syntax.conf", []error{ErrSyntax}},
+		{"sentinel_include.conf", []error{ErrIncludeFailed, ErrFileNotFound}},
+		{"sentinel_url.conf", []error{ErrIncludeFailed, ErrURLFetch}},
+	}
+
+	for _, tt := range tests {
+		err := Load(tt.file)
+		if err == nil {
+			t.Errorf("%s: expected an error", tt.file)
+			continue
+		}
+		for _, want := range tt.want {
+			if !errors.Is(err, want) {
+				t.Errorf("%s: expected %v to match %v", tt.file, err, want)
+			}
+		}
+	}
+
+	err := Load("sentinel_syntax.conf")
+	if errors.Is(err, ErrFileNotFound) || errors.Is(err, ErrIncludeFailed) {
+		t.Errorf("Expected syntax error to match only ErrSyntax, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "invalid syntax at sentinel_syntax.conf:1") {
+		t.Errorf("Expected message with location, got %v", err)
+	}
+}
+
+func TestCommentPrefixes(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "comments_ini.conf", `
+; an INI-style comment
+test.comments {
+    name = "svc" ; trailing comment
+    quoted = "a ; not a comment"
+    tight = a;b
+    hash = #kept
+}
+`)
+
+	SetCommentPrefixes(";")
+	err := Load("comments_ini.conf")
+	assertNoError(t, err)
+
+	assertEnvVar(t, "test.comments.name", "svc")
+	assertEnvVar(t, "test.comments.quoted", "a ; not a comment")
+	assertEnvVar(t, "test.comments.tight", "a;b")
+	assertEnvVar(t, "test.comments.hash", "#kept")
+
+	// Without prefixes the defaults are restored
+	SetCommentPrefixes()
+	createTempConfig(t, "comments_default.conf", `
+# a comment
+test.comments.default = "yes" // trailing
+`)
+	err = Load("comments_default.conf")
+	assertNoError(t, err)
+	assertEnvVar(t, "test.comments.default", "yes")
+}
+
+func TestAsNestedMap(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "nested_tree.conf", `
+test.tree {
+    name = "svc"
+    port = 8080
+    ratio = 0.5
+    debug = true
+    hosts = [ "a", "b" ]
+    db {
+        host = "localhost"
+    }
+}
+`)
+	createTempConfig(t, "nested_tree.json", `{"test": {"tree": {"servers": [{"host": "x"}, {"host": "y"}]}}}`)
+
+	err := Load("nested_tree.conf", "nested_tree.json")
+	assertNoError(t, err)
+
+	tree, err := AsNestedMap()
+	assertNoError(t, err)
+
+	want := map[string]interface{}{
+		"name":  "svc",
+		"port":  int64(8080),
+		"ratio": 0.5,
+		"debug": true,
+		"hosts": []interface{}{"a", "b"},
+		"db":    map[string]interface{}{"host": "localhost"},
+		"servers": []interface{}{
+			map[string]interface{}{"host": "x"},
+			map[string]interface{}{"host": "y"},
+		},
+	}
+	got := tree["test"].(map[string]interface{})["tree"]
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	restore := Override("test.tree.name.first", "x")
+	defer restore()
+	if _, err := AsNestedMap(); err == nil || !strings.Contains(err.Error(), "conflicts") {
+		t.Errorf("Expected scalar/object conflict error, got %v", err)
+	}
+}
+
+func TestIncludeUseCacheOnFailure(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	down := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, `test.urlcache.value = "remote"`)
+	}))
+	defer server.Close()
+
+	createTempConfig(t, "urlcache.conf", fmt.Sprintf(`include url("%s/app.conf")`, server.URL))
+	createTempConfig(t, "urlcache_other.conf", fmt.Sprintf(`include url("%s/other.conf")`, server.URL))
+	cacheDir := filepath.Join(t.TempDir(), "cache")
+
+	SetIncludeCacheDir(cacheDir)
+	err := Load("urlcache.conf")
+	assertNoError(t, err)
+	assertEnvVar(t, "test.urlcache.value", "remote")
+
+	down = true
+	os.Unsetenv("test.urlcache.value")
+
+	// Without the option an unreachable URL still fails
+	Reset()
+	SetIncludeCacheDir(cacheDir)
+	if err := Load("urlcache.conf"); !errors.Is(err, ErrURLFetch) {
+		t.Fatalf("Expected fetch error, got %v", err)
+	}
+
+	Reset()
+	SetIncludeCacheDir(cacheDir)
+	SetIncludeUseCacheOnFailure(true)
+	err = Load("urlcache.conf")
+	assertNoError(t, err)
+	assertEnvVar(t, "test.urlcache.value", "remote")
+
+	found := false
+	for _, w := range Warnings() {
+		if strings.Contains(w, "using cached copy") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected a warning about the cached copy, got %v", Warnings())
+	}
+
+	// A URL that was never cached fails
+	if err := Load("urlcache_other.conf"); !errors.Is(err, ErrURLFetch) {
+		t.Errorf("Expected fetch error without a cached copy, got %v", err)
+	}
+}
+
+func TestKeyCasePolicy(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+	defer os.Unsetenv("Test.CasePolicy.Leaf")
+	defer os.Unsetenv("Test.CasePolicy.URL")
+	defer os.Unsetenv("Test.CasePolicy.url")
+
+	createTempConfig(t, "casepolicy_leaf.conf", `Test.CasePolicy.Leaf = "leaf"`)
+	createTempConfig(t, "casepolicy_asis.conf", `
+Test.CasePolicy.URL = "upper"
+Test.CasePolicy.url = "lower"
+`)
+
+	SetKeyCasePolicy(KeyCaseLowerLeaf)
+	err := Load("casepolicy_leaf.conf")
+	assertNoError(t, err)
+	assertEnvVar(t, "Test.CasePolicy.leaf", "leaf")
+	if got := EnvName("Test.CasePolicy.Leaf"); got != "Test.CasePolicy.leaf" {
+		t.Errorf("Expected only the leaf to be lowercased, got %q", got)
+	}
+
+	Reset()
+	SetKeyCasePolicy(KeyCaseAsIs)
+	err = Load("casepolicy_asis.conf")
+	assertNoError(t, err)
+	assertEnvVar(t, "Test.CasePolicy.URL", "upper")
+	assertEnvVar(t, "Test.CasePolicy.url", "lower")
+
+	if got := GetDefaultValue("Test.CasePolicy.URL", ""); got != "upper" {
+		t.Errorf("Expected the exact key to read its own value, got %q", got)
+	}
+	if got := GetDefaultValue("Test.CasePolicy.url", ""); got != "lower" {
+		t.Errorf("Expected the exact key to read its own value, got %q", got)
+	}
+	if got := GetDefaultValue("test.casepolicy.url", ""); got == "" {
+		t.Error("Expected a read in another case to still find the key")
+	}
+	for _, w := range Warnings() {
+		if strings.Contains(w, "both map to environment variable") {
+			t.Errorf("Expected no collision warning with KeyCaseAsIs, got %q", w)
+		}
+	}
+}
+
+func TestIncludeFallback(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/down.conf" {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, `test.fallback.source = "remote"`)
+	}))
+	defer server.Close()
+
+	createTempConfig(t, "fallback_local.conf", `test.fallback.source = "local"`)
+	createTempConfig(t, "fallback_up.conf", fmt.Sprintf(`include "%s/up.conf" fallback "fallback_local.conf"`, server.URL))
+	createTempConfig(t, "fallback_down.conf", fmt.Sprintf(`include "%s/down.conf" fallback "fallback_local.conf"`, server.URL))
+	createTempConfig(t, "fallback_both.conf", fmt.Sprintf(`include url("%s/down.conf") fallback "fallback_missing.conf"`, server.URL))
+	createTempConfig(t, "fallback_optional.conf", fmt.Sprintf(`include optional url("%s/down.conf") fallback "fallback_missing.conf"`, server.URL))
+
+	err := Load("fallback_up.conf")
+	assertNoError(t, err)
+	assertEnvVar(t, "test.fallback.source", "remote")
+
+	Reset()
+	err = Load("fallback_down.conf")
+	assertNoError(t, err)
+	assertEnvVar(t, "test.fallback.source", "local")
+	if len(Warnings()) == 0 || !strings.Contains(Warnings()[0], "using fallback fallback_local.conf") {
+		t.Errorf("Expected a fallback warning, got %v", Warnings())
+	}
+
+	err = Load("fallback_both.conf")
+	if !errors.Is(err, ErrFileNotFound) || !errors.Is(err, ErrURLFetch) {
+		t.Errorf("Expected both failures to be reported, got %v", err)
+	}
+
+	err = Load("fallback_optional.conf")
+	assertNoError(t, err)
+
+	// A primary that fails to parse fails the include instead of loading the fallback
+	createTempConfig(t, "fallback_broken.conf", "test.fallback.partial = 1\ntest.fallback.bad {\n")
+	createTempConfig(t, "fallback_parse.conf", `include "fallback_broken.conf" fallback "fallback_local.conf"`)
+	Reset()
+	err = Load("fallback_parse.conf")
+	if !errors.Is(err, ErrSyntax) {
+		t.Errorf("Expected the syntax error of the primary, got %v", err)
+	}
+	if _, ok := lookupValue("test.fallback.partial"); ok {
+		t.Error("Expected nothing from the broken primary to be kept")
+	}
+	if _, ok := lookupValue("test.fallback.source"); ok {
+		t.Error("Expected the fallback not to be loaded after a syntax error")
+	}
+}
+
+func TestArrayEnvStyle(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "arraystyle_joined.conf", `test.arraystyle.joined = [ "a", "b,c" ]`)
+	createTempConfig(t, "arraystyle_literal.conf", `test.arraystyle.literal = [ "a", "b" ]`)
+	createTempConfig(t, "arraystyle_indexed.conf", `
+test.arraystyle.indexed = [ "x", "y" ]
+test.arraystyle.scalar = "plain"
+`)
+
+	// Arrays are joined by default
+	err := Load("arraystyle_joined.conf")
+	assertNoError(t, err)
+	assertEnvVar(t, "test.arraystyle.joined", "a,b,c")
+
+	Reset()
+	SetArrayEnvStyle(ArrayEnvLiteral)
+	err = Load("arraystyle_literal.conf")
+	assertNoError(t, err)
+	assertEnvVar(t, "test.arraystyle.literal", `[ "a", "b" ]`)
+
+	Reset()
+	SetArrayEnvStyle(ArrayEnvIndexed)
+	err = Load("arraystyle_indexed.conf")
+	assertNoError(t, err)
+	assertEnvVar(t, "test.arraystyle.indexed_0", "x")
+	assertEnvVar(t, "test.arraystyle.indexed_1", "y")
+	assertEnvVar(t, "test.arraystyle.indexed_COUNT", "2")
+	assertEnvVar(t, "test.arraystyle.scalar", "plain")
+	if _, ok := os.LookupEnv("test.arraystyle.indexed"); ok {
+		t.Error("Expected the joined variable not to be set with ArrayEnvIndexed")
+	}
+
+	// Accessors read the configuration, not the environment
+	if v, ok := GetIndex("test.arraystyle.indexed", 1); !ok || v != "y" {
+		t.Errorf("Expected GetIndex to read y, got %q, %v", v, ok)
+	}
+	if n := GetLen("test.arraystyle.indexed"); n != 2 {
+		t.Errorf("Expected GetLen 2, got %d", n)
+	}
+}
+
+func TestQuotedBracketsStayStrings(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "quoted_brackets.conf", `
+q.ipv6 = "[::1]"
+level = "[WARN]"
+copy = ${level}
+hosts = [a, b]
+hosts_copy = ${hosts}
+`)
+
+	err := Load("quoted_brackets.conf")
+	assertNoError(t, err)
+	assertEnvVar(t, "q.ipv6", "[::1]")
+	assertEnvVar(t, "level", "[WARN]")
+	assertEnvVar(t, "copy", "[WARN]")
+	assertEnvVar(t, "hosts", "a,b")
+	assertEnvVar(t, "hosts_copy", "a,b")
+
+	if n := GetLen("level"); n != 0 {
+		t.Errorf("Expected a quoted value not to be an array, got GetLen %d", n)
+	}
+
+	tree, err := AsNestedMap()
+	assertNoError(t, err)
+	if v := tree["level"]; v != "[WARN]" {
+		t.Errorf("Expected AsNestedMap to keep [WARN] as a string, got %#v", v)
+	}
+	if v := tree["q"].(map[string]interface{})["ipv6"]; v != "[::1]" {
+		t.Errorf("Expected AsNestedMap to keep [::1] as a string, got %#v", v)
+	}
+	if v, ok := tree["hosts"].([]interface{}); !ok || len(v) != 2 {
+		t.Errorf("Expected AsNestedMap to return hosts as an array, got %#v", tree["hosts"])
+	}
+}
+
+func TestSnapshotDiff(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "diff_v1.conf", `
+test.diff {
+    kept = "same"
+    changed = "old"
+    removed = "gone"
+    password = "hunter2"
+}
+`)
+	createTempConfig(t, "diff_v2.conf", `
+test.diff {
+    kept = "same"
+    changed = "new"
+    added = "fresh"
+    password = "swordfish"
+}
+`)
+
+	err := Load("diff_v1.conf")
+	assertNoError(t, err)
+	MarkSecret("test.diff.password")
+	before := TakeSnapshot()
+
+	Reset()
+	err = Load("diff_v2.conf")
+	assertNoError(t, err)
+	after := TakeSnapshot()
+
+	want := []Change{
+		{Key: "test.diff.added", Kind: Added, New: "fresh"},
+		{Key: "test.diff.changed", Kind: Modified, Old: "old", New: "new"},
+		{Key: "test.diff.password", Kind: Modified, Old: "***", New: "***"},
+		{Key: "test.diff.removed", Kind: Removed, Old: "gone"},
+	}
+	if got := before.Diff(after); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	if changes := after.Diff(TakeSnapshot()); len(changes) != 0 {
+		t.Errorf("Expected no changes, got %v", changes)
+	}
+}
+
+func TestParentDirective(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "parent_base.conf", `
+test.parent {
+    name = "base"
+    port = 80
+    debug = false
+}
+`)
+	createTempConfig(t, "parent_extra.conf", `
+test.parent.port = 8080
+test.parent.extra = "yes"
+`)
+	createTempConfig(t, "parent_child.conf", `
+@parent "parent_base.conf"
+@parent "parent_extra.conf"
+
+test.parent.debug = true
+`)
+
+	err := Load("parent_child.conf")
+	assertNoError(t, err)
+
+	assertEnvVar(t, "test.parent.name", "base")
+	assertEnvVar(t, "test.parent.port", "8080")
+	assertEnvVar(t, "test.parent.extra", "yes")
+	assertEnvVar(t, "test.parent.debug", "true")
+	if _, exists := lookupValue("parent"); exists {
+		t.Error("Expected @parent not to be stored as a key")
+	}
+
+	createTempConfig(t, "parent_cycle_a.conf", `
+@parent "parent_cycle_b.conf"
+test.parent.cycle = "a"
+`)
+	createTempConfig(t, "parent_cycle_b.conf", `
+@parent "parent_cycle_a.conf"
+`)
+
+	Reset()
+	err = Load("parent_cycle_a.conf")
+	if err == nil || !strings.Contains(err.Error(), "include cycle") {
+		t.Errorf("Expected a cycle error, got %v", err)
+	}
+
+	createTempConfig(t, "parent_late.conf", `
+test.parent.late = 1
+@parent "parent_base.conf"
+`)
+
+	Reset()
+	err = Load("parent_late.conf")
+	if !errors.Is(err, ErrSyntax) {
+		t.Errorf("Expected ErrSyntax for a late parent, got %v", err)
+	}
+
+	// parent is an ordinary key
+	createTempConfig(t, "parent_ordinary.conf", `
+parent = "parent_base.conf"
+test.parent.child = "yes"
+`)
+
+	Reset()
+	err = Load("parent_ordinary.conf")
+	assertNoError(t, err)
+	assertEnvVar(t, "parent", "parent_base.conf")
+	assertEnvVar(t, "test.parent.child", "yes")
+	if _, exists := lookupValue("test.parent.name"); exists {
+		t.Error("Expected a parent key not to load the file")
+	}
+}
+
+func TestExecValues(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "exec.conf", `
+test.exec.greeting = @exec("echo  hello world")
+test.exec.missing = @exec?("false")
+`)
+
+	err := Load("exec.conf")
+	if err == nil || !strings.Contains(err.Error(), "SetAllowExec") {
+		t.Errorf("Expected @exec to be disabled by default, got %v", err)
+	}
+
+	Reset()
+	SetAllowExec(true)
+	err = Load("exec.conf")
+	assertNoError(t, err)
+
+	assertEnvVar(t, "test.exec.greeting", "hello world")
+	if _, exists := lookupValue("test.exec.missing"); exists {
+		t.Error("Expected a failed optional @exec to leave the key unset")
+	}
+
+	createTempConfig(t, "exec_fail.conf", `
+test.exec.failed = @exec("ls /hoconenv-missing-dir")
+`)
+
+	Reset()
+	SetAllowExec(true)
+	err = Load("exec_fail.conf")
+	if err == nil || !strings.Contains(err.Error(), "hoconenv-missing-dir") || !strings.Contains(err.Error(), "exec_fail.conf:2") {
+		t.Errorf("Expected the command's stderr and location in the error, got %v", err)
+	}
+}
+
+func TestAppendAcrossFiles(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "append_base.conf", `
+test.append {
+    handlers = ["console", "file"]
+    extra = "audit"
+}
+`)
+	createTempConfig(t, "append_override.conf", `
+test.append.handlers += "syslog"
+test.append.handlers += ${test.append.extra}
+test.append.handlers += "last"
+test.append.fresh += 1
+`)
+
+	err := Load("append_base.conf", "append_override.conf")
+	assertNoError(t, err)
+
+	assertEnvVar(t, "test.append.handlers", "console,file,syslog,audit,last")
+	assertEnvVar(t, "test.append.fresh", "1")
+
+	if got := GetLen("test.append.handlers"); got != 5 {
+		t.Errorf("Expected 5 handlers, got %d", got)
+	}
+
+	createTempConfig(t, "append_escaped.conf", `
+test.append.tricky = say "hi, you" \ bye
+test.append.escaped += ${test.append.tricky}
+test.append.escaped += "next"
+`)
+
+	err = Load("append_escaped.conf")
+	assertNoError(t, err)
+
+	if got, _ := GetIndex("test.append.escaped", 0); got != `say "hi, you" \ bye` {
+		t.Errorf("Expected the escaped element to round-trip, got %q", got)
+	}
+	if got := GetLen("test.append.escaped"); got != 2 {
+		t.Errorf("Expected 2 escaped elements, got %d", got)
+	}
+
+	createTempConfig(t, "append_scalar.conf", `
+test.append.scalar = "value"
+test.append.scalar += "more"
+`)
+
+	Reset()
+	err = Load("append_scalar.conf")
+	if err == nil || !strings.Contains(err.Error(), "not an array") {
+		t.Errorf("Expected an error appending to a scalar, got %v", err)
+	}
+}
+
+func TestStrictEnvNames(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "strict_names.conf", `
+test_strict_valid = "ok"
+test.strict.dotted = "dots"
+test.strict.2fa-code = "dash"
+`)
+
+	SetStrictEnvNames(true)
+	err := Load("strict_names.conf")
+	if err == nil || !strings.Contains(err.Error(), "test.strict.2fa-code") || !strings.Contains(err.Error(), "test.strict.dotted") {
+		t.Errorf("Expected the invalid names to be reported, got %v", err)
+	}
+	if strings.Contains(fmt.Sprint(err), "test_strict_valid (") {
+		t.Errorf("Expected valid names not to be reported, got %v", err)
+	}
+	assertEnvVar(t, "test.strict.dotted", "")
+
+	Reset()
+	SetStrictEnvNames(true)
+	SetEnvNameSanitizer(SanitizeEnvName)
+	err = Load("strict_names.conf")
+	assertNoError(t, err)
+
+	assertEnvVar(t, "test_strict_valid", "ok")
+	assertEnvVar(t, "test_strict_dotted", "dots")
+	assertEnvVar(t, "test_strict_2fa_code", "dash")
+
+	if got := SanitizeEnvName("9lives.cat"); got != "_9lives_cat" {
+		t.Errorf("Expected _9lives_cat, got %s", got)
+	}
+}
+
+func TestEnvFallback(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "env_fallback.conf", `
+test.fallback.file = "from file"
+`)
+	os.Setenv("TEST_FALLBACK_ENV", "from env")
+	defer os.Unsetenv("TEST_FALLBACK_ENV")
+
+	SetEnvNameSanitizer(func(name string) string { return strings.ToUpper(SanitizeEnvName(name)) })
+	err := Load("env_fallback.conf")
+	assertNoError(t, err)
+
+	if got := GetDefaultValue("test.fallback.env", "default"); got != "default" {
+		t.Errorf("Expected the default without the fallback, got %s", got)
+	}
+
+	SetEnvFallback(true)
+	if got := GetDefaultValue("test.fallback.env", "default"); got != "from env" {
+		t.Errorf("Expected the environment value, got %s", got)
+	}
+	if got := GetDefaultValue("test.fallback.file", "default"); got != "from file" {
+		t.Errorf("Expected the file value, got %s", got)
+	}
+	if got := GetDefaultValue("test.fallback.missing", "default"); got != "default" {
+		t.Errorf("Expected the default, got %s", got)
+	}
+}
+
+func TestURLIncludeTimeout(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		fmt.Fprintln(w, `test.timeout.value = "slow"`)
+	}))
+	defer server.Close()
+
+	createTempConfig(t, "timeout_short.conf", fmt.Sprintf(`include url("%s") timeout(50ms)`, server.URL))
+	err := Load("timeout_short.conf")
+	if !errors.Is(err, ErrURLFetch) {
+		t.Errorf("Expected the fetch to time out, got %v", err)
+	}
+
+	createTempConfig(t, "timeout_long.conf", fmt.Sprintf(`include url("%s") timeout(5s)`, server.URL))
+	Reset()
+	err = Load("timeout_long.conf")
+	assertNoError(t, err)
+	assertEnvVar(t, "test.timeout.value", "slow")
+
+	createTempConfig(t, "timeout_invalid.conf", fmt.Sprintf(`include url("%s") timeout(soon)`, server.URL))
+	Reset()
+	err = Load("timeout_invalid.conf")
+	if err == nil || !strings.Contains(err.Error(), "invalid include timeout") {
+		t.Errorf("Expected an invalid timeout error, got %v", err)
+	}
+
+	// A timeout on an include without a URL would have no effect, so it is an error
+	createTempConfig(t, "timeout_target.conf", `test.timeout.file = "loaded"`)
+	for _, include := range []string{`"timeout_target.conf"`, `glob("timeout_*.conf")`, `directory(".")`} {
+		createTempConfig(t, "timeout_file.conf", "include "+include+" timeout(5s)")
+		Reset()
+		err = Load("timeout_file.conf")
+		if err == nil || !strings.Contains(err.Error(), "only applies to URL includes") {
+			t.Errorf("Expected a timeout on include %s to be rejected, got %v", include, err)
+		}
+	}
+
+	// With a URL among the candidates, the timeout applies to it
+	createTempConfig(t, "timeout_fallback.conf", fmt.Sprintf(`include url("%s") fallback "timeout_target.conf" timeout(5s)`, server.URL))
+	Reset()
+	err = Load("timeout_fallback.conf")
+	assertNoError(t, err)
+}
+
+func TestSaveAndRestoreState(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "fixture_base.conf", `
+test.fixture {
+    name = "base"
+    hosts = ["a", "b"]
+}
+`)
+	createTempConfig(t, "fixture.conf", `
+include "fixture_base.conf"
+secret test.fixture.password
+test.fixture.password = "hunter2"
+`)
+
+	SetTrackOrigins(true)
+	SetPrefix("fx")
+	err := Load("fixture.conf")
+	assertNoError(t, err)
+
+	err = SaveState("state.json")
+	assertNoError(t, err)
+
+	// The fixture must not depend on the original files
+	os.Remove("fixture.conf")
+	os.Remove("fixture_base.conf")
+	os.Unsetenv("fx.test.fixture.name")
+
+	Reset()
+	err = RestoreState("state.json")
+	assertNoError(t, err)
+
+	assertEnvVar(t, "fx.test.fixture.name", "base")
+	if got := GetDefaultValue("test.fixture.name", ""); got != "base" {
+		t.Errorf("Expected base, got %s", got)
+	}
+	if got := GetLen("test.fixture.hosts"); got != 2 {
+		t.Errorf("Expected 2 hosts, got %d", got)
+	}
+	if got := Origin("test.fixture.name"); !strings.HasSuffix(got, "fixture_base.conf:3") {
+		t.Errorf("Expected the origin to be restored, got %s", got)
+	}
+	if files := LoadedFiles(); len(files) != 2 {
+		t.Errorf("Expected 2 loaded files, got %v", files)
+	}
+
+	var buf bytes.Buffer
+	err = Export(&buf)
+	assertNoError(t, err)
+	if strings.Contains(buf.String(), "hunter2") {
+		t.Errorf("Expected the secret to stay redacted, got %s", buf.String())
+	}
+
+	createTempConfig(t, "bad_state.json", `{"version": 99}`)
+	err = RestoreState("bad_state.json")
+	if err == nil || !strings.Contains(err.Error(), "version") {
+		t.Errorf("Expected a version error, got %v", err)
+	}
+	if got := GetDefaultValue("test.fixture.name", ""); got != "base" {
+		t.Errorf("Expected a failed restore to keep the configuration, got %s", got)
+	}
+}
+
+func TestIncludeSortNatural(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "sorted/v1.conf", `test.sort.version = "v1"`)
+	createTempConfig(t, "sorted/v2.conf", `test.sort.version = "v2"`)
+	createTempConfig(t, "sorted/v10.conf", `test.sort.version = "v10"`)
+	createTempConfig(t, "sort_dir.conf", `include directory("sorted")`)
+	createTempConfig(t, "sort_glob.conf", `include "sorted/v*.conf"`)
+
+	for _, file := range []string{"sort_dir.conf", "sort_glob.conf"} {
+		Reset()
+		err := Load(file)
+		assertNoError(t, err)
+		assertEnvVar(t, "test.sort.version", "v2")
+
+		Reset()
+		SetIncludeSort(IncludeSortNatural)
+		err = Load(file)
+		assertNoError(t, err)
+		assertEnvVar(t, "test.sort.version", "v10")
+	}
+
+	names := []string{"010-override.conf", "v10.conf", "2-b.conf", "v2.conf", "001-base.conf", "v02.conf"}
+	want := []string{"001-base.conf", "2-b.conf", "010-override.conf", "v02.conf", "v2.conf", "v10.conf"}
+	SetIncludeSort(IncludeSortNatural)
+	sortIncludeNames(names)
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("Expected %v, got %v", want, names)
+	}
+}
+
+func TestDefaultsInclude(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "defaults_base.conf", `
+test.defaults {
+    host = "localhost"
+    port = 5432
+}
+`)
+	createTempConfig(t, "defaults_main.conf", `
+test.defaults.host = "db.example.com"
+include defaults("defaults_base.conf")
+`)
+
+	err := Load("defaults_main.conf")
+	assertNoError(t, err)
+
+	assertEnvVar(t, "test.defaults.host", "db.example.com")
+	assertEnvVar(t, "test.defaults.port", "5432")
+
+	createTempConfig(t, "defaults_later.conf", `
+include defaults("defaults_base.conf")
+test.defaults.port = 6543
+`)
+
+	Reset()
+	err = Load("defaults_later.conf")
+	assertNoError(t, err)
+	assertEnvVar(t, "test.defaults.port", "6543")
+	assertEnvVar(t, "test.defaults.host", "localhost")
+
+	// Keys from an earlier load win as well
+	createTempConfig(t, "defaults_only.conf", `include defaults("defaults_base.conf")`)
+	Reset()
+	Load("defaults_main.conf")
+	err = Load("defaults_only.conf")
+	assertNoError(t, err)
+	assertEnvVar(t, "test.defaults.host", "db.example.com")
+
+	createTempConfig(t, "defaults_invalid.conf", `include defaults("defaults_base.conf"`)
+	Reset()
+	err = Load("defaults_invalid.conf")
+	if err == nil || !strings.Contains(err.Error(), "invalid defaults") {
+		t.Errorf("Expected an invalid defaults error, got %v", err)
+	}
+}
+
+func TestGetWithOrigin(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "with_origin.conf", `
+test.withorigin {
+    name = "explorer"
+}
+`)
+
+	SetPrefix("app")
+	err := Load("with_origin.conf")
+	assertNoError(t, err)
+
+	value, origin, ok := GetWithOrigin("app.test.withorigin.name")
+	if !ok || value != "explorer" || origin != "" {
+		t.Errorf("Expected the value without an origin, got %q, %q, %v", value, origin, ok)
+	}
+
+	Reset()
+	SetTrackOrigins(true)
+	err = Load("with_origin.conf")
+	assertNoError(t, err)
+
+	value, origin, ok = GetWithOrigin("TEST.WITHORIGIN.NAME")
+	if !ok || value != "explorer" || !strings.HasSuffix(origin, "with_origin.conf:3") {
+		t.Errorf("Expected the value and its origin, got %q, %q, %v", value, origin, ok)
+	}
+
+	if _, _, ok := GetWithOrigin("test.withorigin.missing"); ok {
+		t.Error("Expected a missing key to report false")
+	}
+}
+
+func TestGetStringMapString(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "string_map.conf", `
+test.stringmap.headers {
+    "X-Api-Key" = abc
+    Accept = "application/json"
+    retry {
+        count = 3
+    }
+}
+`)
+
+	SetPrefix("app")
+	err := Load("string_map.conf")
+	assertNoError(t, err)
+
+	want := map[string]string{"X-Api-Key": "abc", "Accept": "application/json"}
+	if got := GetStringMapString("app.test.stringmap.headers"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if got := GetDefaultValue("test.stringmap.headers.x-api-key", ""); got != "abc" {
+		t.Errorf("Expected the quoted key to be stored unquoted, got %q", got)
+	}
+	if got := GetStringMapString("test.stringmap.missing"); len(got) != 0 {
+		t.Errorf("Expected an empty map, got %v", got)
+	}
+}
+
+func TestIncludeLines(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "lines_big.conf", `# shared sections
+test.lines.first = "one"
+
+test.lines.second = "two"
+test.lines.third = "three"
+`)
+	createTempConfig(t, "lines_main.conf", `include "lines_big.conf" lines(4-5)`)
+
+	SetTrackOrigins(true)
+	err := Load("lines_main.conf")
+	assertNoError(t, err)
+
+	assertEnvVar(t, "test.lines.second", "two")
+	assertEnvVar(t, "test.lines.third", "three")
+	if _, ok := lookupValue("test.lines.first"); ok {
+		t.Error("Expected lines outside the range to be skipped")
+	}
+	if got := Origin("test.lines.third"); !strings.HasSuffix(got, "lines_big.conf:5") {
+		t.Errorf("Expected the origin to keep the file's line numbers, got %s", got)
+	}
+
+	createTempConfig(t, "lines_range.conf", `include "lines_big.conf" lines(4-50)`)
+	Reset()
+	err = Load("lines_range.conf")
+	if err == nil || !strings.Contains(err.Error(), "out of range") {
+		t.Errorf("Expected an out of range error, got %v", err)
+	}
+
+	createTempConfig(t, "lines_optional.conf", `include optional "lines_big.conf" lines(4-50)`)
+	Reset()
+	err = Load("lines_optional.conf")
+	assertNoError(t, err)
+
+	createTempConfig(t, "lines_self.conf", `include "lines_self.conf" lines(1-1)`)
+	Reset()
+	err = Load("lines_self.conf")
+	if err == nil || !strings.Contains(err.Error(), "include cycle") {
+		t.Errorf("Expected a cycle error, got %v", err)
+	}
+
+	createTempConfig(t, "lines_invalid.conf", `include "lines_big.conf" lines(5-4)`)
+	Reset()
+	err = Load("lines_invalid.conf")
+	if err == nil || !strings.Contains(err.Error(), "invalid include lines") {
+		t.Errorf("Expected an invalid range error, got %v", err)
+	}
+}
+
+func TestReloadFile(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "reload_base.conf", `
+test.reload.name = "base"
+test.reload.shared = "base"
+`)
+	createTempConfig(t, "reload_app.conf", `
+test.reload.port = 8080
+test.reload.stale = "old"
+test.reload.shared = "app"
+`)
+
+	err := ReloadFile("reload_app.conf")
+	if err == nil || !strings.Contains(err.Error(), "SetTrackOrigins") {
+		t.Errorf("Expected origin tracking to be required, got %v", err)
+	}
+
+	SetTrackOrigins(true)
+	err = Load("reload_base.conf", "reload_app.conf")
+	assertNoError(t, err)
+
+	createTempConfig(t, "reload_app.conf", `
+test.reload.port = 9090
+test.reload.fresh = "new"
+`)
+	os.Remove("reload_base.conf")
+
+	err = ReloadFile("reload_app.conf")
+	assertNoError(t, err)
+
+	assertEnvVar(t, "test.reload.name", "base")
+	assertEnvVar(t, "test.reload.port", "9090")
+	assertEnvVar(t, "test.reload.fresh", "new")
+	assertEnvVar(t, "test.reload.stale", "")
+	if _, ok := lookupValue("test.reload.stale"); ok {
+		t.Error("Expected the stale key to be removed")
+	}
+	if got := Origin("test.reload.port"); !strings.HasSuffix(got, "reload_app.conf:2") {
+		t.Errorf("Expected the origin of the reloaded key, got %s", got)
+	}
+
+	createTempConfig(t, "reload_app.conf", `test.reload.broken {`)
+	err = ReloadFile("reload_app.conf")
+	if !errors.Is(err, ErrSyntax) {
+		t.Errorf("Expected a syntax error, got %v", err)
+	}
+	assertEnvVar(t, "test.reload.fresh", "new")
+
+	if err := ReloadFile("reload_other.conf"); err == nil {
+		t.Error("Expected an error for a file that was not loaded")
+	}
+
+	// An included file can't be reloaded without the context it was included in
+	createTempConfig(t, "reload_vendor.conf", `a = "vendored"`)
+	createTempConfig(t, "reload_main.conf", `
+prefix "vendor" {
+    include "reload_vendor.conf"
+}
+`)
+
+	err = Load("reload_main.conf")
+	assertNoError(t, err)
+
+	err = ReloadFile("reload_vendor.conf")
+	if err == nil || !strings.Contains(err.Error(), "included") {
+		t.Errorf("Expected an error reloading an included file, got %v", err)
+	}
+	if got := GetDefaultValue("vendor.a", ""); got != "vendored" {
+		t.Errorf("Expected the included key to stay in place, got %q", got)
+	}
+
+	err = ReloadFile("reload_main.conf")
+	assertNoError(t, err)
+	if got := GetDefaultValue("vendor.a", ""); got != "vendored" {
+		t.Errorf("Expected the including file to reload the include in place, got %q", got)
+	}
+}
+
+func TestReloadFileKeepsLaterOverrides(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "a.conf", `
+r.x = "from-a"
+r.y = ${r.x}
+`)
+	createTempConfig(t, "b.conf", `
+r.x = "from-b"
+r.y = "from-b"
+`)
+
+	SetTrackOrigins(true)
+	err := Load("a.conf", "b.conf")
+	assertNoError(t, err)
+	assertEnvVar(t, "r.x", "from-b")
+
+	// Reloading the unchanged earlier file leaves the keys the later file overrode alone
+	err = ReloadFile("a.conf")
+	assertNoError(t, err)
+	assertEnvVar(t, "r.x", "from-b")
+	assertEnvVar(t, "r.y", "from-b")
+	if v, _ := lookupValue("r.x"); v != "from-b" {
+		t.Errorf("Expected r.x to stay from-b in the configuration, got %s", v)
+	}
+}
+
+func TestConfigNameEnv(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "application.conf", `test.configname.source = "application"`)
+	createTempConfig(t, "service.conf", `test.configname.source = "service"`)
+
+	t.Setenv("CONFIG_NAME", "service")
+	err := Load()
+	assertNoError(t, err)
+	assertEnvVar(t, "test.configname.source", "service")
+
+	Reset()
+	SetConfigNameEnv("APP_CONFIG_NAME")
+	err = Load()
+	assertNoError(t, err)
+	assertEnvVar(t, "test.configname.source", "application")
+
+	t.Setenv("APP_CONFIG_NAME", "service")
+	Reset()
+	SetConfigNameEnv("APP_CONFIG_NAME")
+	err = Load()
+	assertNoError(t, err)
+	assertEnvVar(t, "test.configname.source", "service")
+
+	Reset()
+	SetConfigNameEnv("")
+	err = Load()
+	assertNoError(t, err)
+	assertEnvVar(t, "test.configname.source", "application")
+
+	// Patterns set by the program take precedence over the variable
+	Reset()
+	SetDefaultFilePattern("application.conf")
+	err = Load()
+	assertNoError(t, err)
+	assertEnvVar(t, "test.configname.source", "application")
+}
+
+func TestFreeze(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "freeze.conf", `test.freeze.name = "startup"`)
+	createTempConfig(t, "freeze_later.conf", `test.freeze.name = "later"`)
+
+	err := Load("freeze.conf")
+	assertNoError(t, err)
+
+	if Frozen() {
+		t.Error("Expected the configuration not to be frozen yet")
+	}
+	Freeze()
+	if !Frozen() {
+		t.Error("Expected the configuration to be frozen")
+	}
+
+	if err := Load("freeze_later.conf"); !errors.Is(err, ErrFrozen) {
+		t.Errorf("Expected Load to fail with ErrFrozen, got %v", err)
+	}
+	if err := LoadReader(strings.NewReader(`test.freeze.name = "reader"`), "reader.conf"); !errors.Is(err, ErrFrozen) {
+		t.Errorf("Expected LoadReader to fail with ErrFrozen, got %v", err)
+	}
+
+	SetPrefix("frozen")
+	if got := EnvName("test.freeze.name"); got != "test.freeze.name" {
+		t.Errorf("Expected SetPrefix to be ignored, got %s", got)
+	}
+	if warnings := Warnings(); len(warnings) == 0 || !strings.Contains(warnings[len(warnings)-1], "frozen") {
+		t.Errorf("Expected a warning for SetPrefix, got %v", warnings)
+	}
+
+	assertEnvVar(t, "test.freeze.name", "startup")
+	if got := GetDefaultValue("test.freeze.name", ""); got != "startup" {
+		t.Errorf("Expected reads to keep working, got %s", got)
+	}
+
+	// Override still works, since it undoes itself
+	restore := Override("test.freeze.name", "override")
+	assertEnvVar(t, "test.freeze.name", "override")
+	restore()
+	assertEnvVar(t, "test.freeze.name", "startup")
+
+	// Lazy loaders that run after Freeze can't load their section
+	RegisterLazy("test.freeze.lazy", func() error {
+		return Load("freeze_later.conf")
+	})
+	if got := GetDefaultValue("test.freeze.lazy.key", "unset"); got != "unset" {
+		t.Errorf("Expected the lazy section not to load, got %s", got)
+	}
+	if warnings := Warnings(); len(warnings) == 0 || !strings.Contains(warnings[len(warnings)-1], "frozen") {
+		t.Errorf("Expected a warning for the lazy loader, got %v", warnings)
+	}
+
+	Reset()
+	if Frozen() {
+		t.Error("Expected Reset to unfreeze the configuration")
+	}
+	err = Load("freeze_later.conf")
+	assertNoError(t, err)
+}
+
+func TestUnmarshalSlicesAndMaps(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "collections.conf", `
+test.collections {
+    hosts = ["a.example.com", "b.example.com"]
+    ports = [80, 443]
+    headers {
+        "X-Api-Key" = abc
+        Accept = "application/json"
+        cache.control = "no-store"
+    }
+    limits {
+        read = 10
+        write = 5
+    }
+}
+`)
+	createTempConfig(t, "collections.json", `{"test": {"collections": {"weights": [1, 2, 3]}}}`)
+
+	err := Load("collections.conf", "collections.json")
+	assertNoError(t, err)
+
+	type Collections struct {
+		Hosts   []string          `hocon:"hosts"`
+		Ports   []int             `hocon:"ports"`
+		Weights []int             `hocon:"weights"`
+		Headers map[string]string `hocon:"headers"`
+		Limits  map[string]int    `hocon:"limits"`
+		Missing []string          `hocon:"missing"`
+	}
+	var cfg struct {
+		Collections Collections `hocon:"test.collections"`
+	}
+
+	err = Unmarshal(&cfg)
+	assertNoError(t, err)
+
+	want := Collections{
+		Hosts:   []string{"a.example.com", "b.example.com"},
+		Ports:   []int{80, 443},
+		Weights: []int{1, 2, 3},
+		Headers: map[string]string{"X-Api-Key": "abc", "Accept": "application/json", "cache.control": "no-store"},
+		Limits:  map[string]int{"read": 10, "write": 5},
+	}
+	if !reflect.DeepEqual(cfg.Collections, want) {
+		t.Errorf("Expected %+v, got %+v", want, cfg.Collections)
+	}
+
+	createTempConfig(t, "collections_bad.conf", `
+test.badcollections {
+    ports = [80, http]
+    limits {
+        read = many
+    }
+}
+`)
+	Reset()
+	err = Load("collections_bad.conf")
+	assertNoError(t, err)
+
+	var bad struct {
+		Ports  []int          `hocon:"test.badcollections.ports"`
+		Limits map[string]int `hocon:"test.badcollections.limits"`
+	}
+	errs := Decode(&bad)
+	if len(errs) != 2 {
+		t.Fatalf("Expected 2 errors, got %v", errs)
+	}
+	for i, want := range []string{`Ports[1] (key test.badcollections.ports.1): cannot decode "http"`, `Limits[read] (key test.badcollections.limits.read): cannot decode "many"`} {
+		if !strings.Contains(errs[i].Error(), want) {
+			t.Errorf("Expected error %d to contain %q, got %v", i, want, errs[i])
+		}
+	}
+	if bad.Ports != nil || bad.Limits != nil {
+		t.Errorf("Expected fields with errors to stay unset, got %+v", bad)
+	}
+}
+
+func TestDumpSorted(t *testing.T) {
+	cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	createTempConfig(t, "dump.conf", `
+test.dump {
+    zone = "eu"
+    motd = "Hello
+world\path"
+    password = "hunter2"
+    hosts = ["a", "b"]
+}
+secret test.dump.password
+`)
+
+	SetPrefix("app")
+	SetEnvNameSanitizer(SanitizeEnvName)
+	SetArrayEnvStyle(ArrayEnvJoined)
+	err := Load("dump.conf")
+	assertNoError(t, err)
+
+	var buf bytes.Buffer
+	err = DumpSorted(&buf)
+	assertNoError(t, err)
+
+	want := `app_test_dump_hosts=a,b
+app_test_dump_motd=Hello\nworld\\path
+app_test_dump_password=***
+app_test_dump_zone=eu
+`
+	if buf.String() != want {
+		t.Errorf("Expected:\n%s\nGot:\n%s", want, buf.String())
+	}
+}
@@ -1,13 +1,22 @@
 package hoconenv
 
 import (
-	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"math"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -21,27 +30,528 @@ const (
 	includeOptional
 )
 
+// httpClient is shared by all URL includes so connections can be reused and closed by Close
+var httpClient = newHTTPClient()
+
+// defaultPriority is the priority of top-level files and of includes without a priority(n) annotation
+const defaultPriority = 50
+
+// defaultsPriority is the priority of defaults(...) includes, below any other source
+const defaultsPriority = math.MinInt
+
+var (
+	requireNonEmptyIncludes = false
+
+	// parsedKeys counts the assignments parsed so far, to tell whether an include assigned any
+	parsedKeys atomic.Int64
+
+	// includePriority is the priority of the include currently being loaded
+	includePriority = defaultPriority
+
+	// keyPriority records the priority each key was last assigned with during a load
+	keyPriority = make(map[string]int)
+
+	// includeTimeout overrides the client timeout for the URL include currently being loaded, if set
+	includeTimeout time.Duration
+)
+
+// parseIncludePriority parses the priority(n) annotation at the start of includeStr and
+// returns the priority along with the remainder of the include directive
+func parseIncludePriority(includeStr string) (int, string, error) {
+	value, rest, ok := splitParenthesized(strings.TrimPrefix(includeStr, "priority"))
+	if !ok {
+		return 0, "", fmt.Errorf("unterminated include priority %q", includeStr)
+	}
+
+	priority, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid include priority %q", value)
+	}
+
+	return priority, strings.TrimSpace(rest), nil
+}
+
+// swapIncludePriority sets the priority for values loaded from now on and returns the previous one
+func swapIncludePriority(priority int) int {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	previous := includePriority
+	includePriority = priority
+	return previous
+}
+
+// acceptPriority reports whether a value with the given priority may override the current value
+// of key, recording the priority if so. Equal priorities keep last-write-wins semantics.
+// The caller must hold the mutex
+func acceptPriority(key string, priority int) bool {
+	current, exists := keyPriority[key]
+	if exists && current > priority {
+		return false
+	}
+
+	// A defaults(...) include also leaves keys alone that an earlier load set
+	if !exists && priority == defaultsPriority {
+		if _, loaded := canonicalKey(key); loaded {
+			return false
+		}
+	}
+
+	keyPriority[key] = priority
+	return true
+}
+
+// conditionPattern matches the supported include predicates: env("NAME") == "value" and env("NAME") != "value"
+var conditionPattern = regexp.MustCompile(`^env\(\s*["']([^"']+)["']\s*\)\s*(==|!=)\s*["']([^"']*)["']$`)
+
+// evaluateIncludeCondition evaluates the if(...) clause at the start of includeStr and
+// returns whether it holds along with the remainder of the include directive
+func evaluateIncludeCondition(includeStr string) (bool, string, error) {
+	expr, rest, ok := splitParenthesized(strings.TrimPrefix(includeStr, "if"))
+	if !ok {
+		return false, "", fmt.Errorf("unterminated include condition %q", includeStr)
+	}
+
+	match := conditionPattern.FindStringSubmatch(strings.TrimSpace(expr))
+	if match == nil {
+		return false, "", fmt.Errorf("invalid include condition %q", expr)
+	}
+
+	rest = strings.TrimSpace(rest)
+	if rest == "" {
+		return false, "", fmt.Errorf("missing include target after condition %q", expr)
+	}
+
+	equal := os.Getenv(match[1]) == match[3]
+	if match[2] == "!=" {
+		equal = !equal
+	}
+
+	return equal, rest, nil
+}
+
+// splitParenthesized splits a string starting with "(" into the text inside the
+// matching ")" and whatever follows it, ignoring parentheses inside quotes
+func splitParenthesized(s string) (string, string, bool) {
+	if !strings.HasPrefix(s, "(") {
+		return "", "", false
+	}
+
+	depth := 0
+	var quote rune
+	for i, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '(':
+			depth++
+		case r == ')':
+			depth--
+			if depth == 0 {
+				return s[1:i], s[i+1:], true
+			}
+		}
+	}
+
+	return "", "", false
+}
+
+// splitIncludeHint splits a trailing or "hint" off an include target, ignoring "or" inside
+// quotes or parentheses. The hint is empty if there is none
+func splitIncludeHint(s string) (string, string) {
+	target, hint, found := cutIncludeKeyword(s, "or")
+	if found && len(hint) >= 2 && (hint[0] == '"' || hint[0] == '\'') && hint[len(hint)-1] == hint[0] {
+		return target, hint[1 : len(hint)-1]
+	}
+
+	return s, ""
+}
+
+// cutIncludeKeyword splits an include target around the first " keyword " outside quotes or
+// parentheses, trimming both sides
+func cutIncludeKeyword(s, keyword string) (string, string, bool) {
+	separator := " " + keyword + " "
+
+	depth := 0
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case depth == 0 && strings.HasPrefix(s[i:], separator):
+			return strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+len(separator):]), true
+		}
+	}
+
+	return s, "", false
+}
+
+// cutIncludeOption splits a trailing name(argument) option, such as timeout(60s), off an
+// include target outside quotes. found is false if there is none
+func cutIncludeOption(s, name string) (target string, arg string, found bool, err error) {
+	i := strings.LastIndex(s, " "+name+"(")
+	if i == -1 || strings.Count(s[:i], "\"")%2 != 0 {
+		return s, "", false, nil
+	}
+
+	value, rest, ok := splitParenthesized(s[i+len(name)+1:])
+	if !ok || strings.TrimSpace(rest) != "" {
+		return "", "", true, fmt.Errorf("invalid include %s %q", name, strings.TrimSpace(s[i:]))
+	}
+
+	return strings.TrimSpace(s[:i]), strings.Trim(strings.TrimSpace(value), "\"'"), true, nil
+}
+
+// splitIncludeTimeout splits a trailing timeout(duration) off an include target. The duration
+// is zero if there is none
+func splitIncludeTimeout(s string) (string, time.Duration, error) {
+	target, value, found, err := cutIncludeOption(s, "timeout")
+	if !found || err != nil {
+		return target, 0, err
+	}
+
+	timeout, err := parseDuration(value)
+	if err != nil || timeout <= 0 {
+		return "", 0, fmt.Errorf("invalid include timeout %q", value)
+	}
+
+	return target, timeout, nil
+}
+
+// lineRange is an inclusive range of 1-based line numbers selected by lines(from-to)
+type lineRange struct {
+	from, to int
+}
+
+// splitIncludeLines splits a trailing lines(from-to) off an include target. The range is nil
+// if there is none
+func splitIncludeLines(s string) (string, *lineRange, error) {
+	target, value, found, err := cutIncludeOption(s, "lines")
+	if !found || err != nil {
+		return target, nil, err
+	}
+
+	fromText, toText, _ := strings.Cut(value, "-")
+	from, fromErr := strconv.Atoi(strings.TrimSpace(fromText))
+	to, toErr := strconv.Atoi(strings.TrimSpace(toText))
+	if fromErr != nil || toErr != nil || from < 1 || to < from {
+		return "", nil, fmt.Errorf("invalid include lines %q", value)
+	}
+
+	return target, &lineRange{from: from, to: to}, nil
+}
+
+// handleLinesInclude parses only the selected lines of a plain file. Errors and origins keep
+// the line numbers of the whole file. The file isn't marked as loaded, so the rest of it can
+// still be included
+func handleLinesInclude(file string, lines *lineRange, required bool, currentFile string) error {
+	file = strings.Trim(file, "\"'")
+	if strings.Contains(file, "(") || strings.Contains(file, "*") {
+		return fmt.Errorf("include lines(...) only supports plain files in %s: %s", currentFile, file)
+	}
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(filepath.Dir(currentFile), file)
+	}
+
+	fail := func(err error) error {
+		if required {
+			return fmt.Errorf("failed to include required file %s: %w", file, err)
+		}
+		warn("Optional include lines of %s skipped: %v", file, err)
+		return nil
+	}
+
+	// The selection is tracked on its own, so a file can include other lines of itself
+	selection := fmt.Sprintf("%s:%d-%d", file, lines.from, lines.to)
+	mutex.Lock()
+	if parsingFiles[selection] {
+		mutex.Unlock()
+		return fmt.Errorf("include cycle: %s includes itself", selection)
+	}
+	parsingFiles[selection] = true
+	mutex.Unlock()
+
+	defer func() {
+		mutex.Lock()
+		delete(parsingFiles, selection)
+		mutex.Unlock()
+	}()
+
+	reader, err := openConfigFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fail(fmt.Errorf("%w: %s", ErrFileNotFound, file))
+		}
+		return fail(err)
+	}
+	data, err := io.ReadAll(decodeReader(reader, configuredEncoding()))
+	reader.Close()
+	if err != nil {
+		return fail(err)
+	}
+
+	all := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if lines.to > len(all) {
+		return fail(fmt.Errorf("lines %d-%d out of range, the file has %d lines", lines.from, lines.to, len(all)))
+	}
+
+	// Blank lines in place of the skipped ones keep the line numbers of the file
+	selected := strings.Repeat("\n", lines.from-1) + strings.Join(all[lines.from-1:lines.to], "\n")
+
+	recordInclude(currentFile, file)
+	return parseReader(strings.NewReader(selected), file)
+}
+
+// hasURLTarget reports whether an include, or one of its fallback or first(...) candidates,
+// is a URL that an include timeout can apply to
+func hasURLTarget(includeStr string) bool {
+	return strings.Contains(includeStr, "url(") || strings.Contains(includeStr, "http://") || strings.Contains(includeStr, "https://")
+}
+
+// swapIncludeTimeout sets the timeout for URL includes loaded from now on and returns the previous one
+func swapIncludeTimeout(timeout time.Duration) time.Duration {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	previous := includeTimeout
+	includeTimeout = timeout
+	return previous
+}
+
+// fetchURL gets urlStr with the shared client, or within the include timeout if one is set
+func fetchURL(urlStr string) (*http.Response, context.CancelFunc, error) {
+	mutex.RLock()
+	timeout := includeTimeout
+	mutex.RUnlock()
+
+	if timeout == 0 {
+		resp, err := httpClient.Get(urlStr)
+		return resp, func() {}, err
+	}
+
+	// The context sets the deadline, so the client's own timeout must not cut the fetch short
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, urlStr, nil)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+
+	client := *httpClient
+	client.Timeout = 0
+	resp, err := client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+
+	return resp, cancel, nil
+}
+
+// handleFallbackInclude loads primary, typically a URL, and loads fallback instead if primary
+// can't be found or fetched. Any other error from primary fails the include. Otherwise the
+// include only fails if it is required and both fail
+func handleFallbackInclude(primary, fallback string, required bool, currentFile string) error {
+	err := includeCandidate(primary, currentFile)
+	if err == nil || !isUnavailable(err) {
+		return err
+	}
+
+	warn("Failed to include %s, using fallback %s: %v", strings.Trim(primary, "\"'"), strings.Trim(fallback, "\"'"), err)
+
+	if fallbackErr := dispatchInclude(fallback, required, currentFile); fallbackErr != nil {
+		return fmt.Errorf("%w (after %w)", fallbackErr, err)
+	}
+	return nil
+}
+
+// handleFirstInclude tries each comma-separated candidate of a first(...) include in order and
+// stops at the first one that loads. Only a candidate that can't be found or fetched moves on to
+// the next, any other error fails the include. Otherwise it only fails if the include is
+// required and no candidate loads
+func handleFirstInclude(args string, required bool, currentFile string) error {
+	candidates := splitCandidates(args)
+	if len(candidates) == 0 {
+		return fmt.Errorf("first(...) include without candidates in %s", currentFile)
+	}
+
+	var failures []string
+	for _, candidate := range candidates {
+		err := includeCandidate(candidate, currentFile)
+		if err == nil {
+			return nil
+		}
+		if !isUnavailable(err) {
+			return err
+		}
+		failures = append(failures, err.Error())
+	}
+
+	if required {
+		return fmt.Errorf("no candidate of first(...) could be included in %s: %s", currentFile, strings.Join(failures, "; "))
+	}
+
+	return nil
+}
+
+// includeCandidate loads one candidate of an include that falls back to others. A candidate that
+// turns out to be unavailable is rolled back, so keys it assigned before the failure don't mix
+// with those of the next candidate
+func includeCandidate(spec, currentFile string) error {
+	mutex.Lock()
+	saved := captureState()
+	mutex.Unlock()
+
+	err := dispatchInclude(spec, true, currentFile)
+	if err != nil && isUnavailable(err) {
+		mutex.Lock()
+		restoreState(saved)
+		mutex.Unlock()
+	}
+
+	return err
+}
+
+// isUnavailable reports whether err means an include target couldn't be found or fetched, the
+// only failures after which the next candidate is tried. Other errors, such as syntax errors,
+// fail the include
+func isUnavailable(err error) bool {
+	return errors.Is(err, ErrFileNotFound) || errors.Is(err, ErrURLFetch) || errors.Is(err, fs.ErrNotExist)
+}
+
+// splitCandidates splits a comma-separated list, ignoring commas inside quotes or parentheses
+func splitCandidates(s string) []string {
+	var candidates []string
+	depth, start := 0, 0
+	var quote rune
+
+	add := func(candidate string) {
+		if candidate = strings.TrimSpace(candidate); candidate != "" {
+			candidates = append(candidates, candidate)
+		}
+	}
+
+	for i, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '(':
+			depth++
+		case r == ')':
+			depth--
+		case r == ',' && depth == 0:
+			add(s[start:i])
+			start = i + 1
+		}
+	}
+	add(s[start:])
+
+	return candidates
+}
+
+// handleAlwaysInclude processes an include always, which only supports plain files
+func handleAlwaysInclude(includeStr string, required bool, currentFile string) error {
+	file := strings.Trim(includeStr, "\"'")
+	if strings.Contains(file, "(") || strings.Contains(file, "*") {
+		return fmt.Errorf("include always only supports plain files in %s: %s", currentFile, includeStr)
+	}
+
+	return handleFileInclude(file, required, currentFile, true)
+}
+
+// SetRequireNonEmptyIncludes makes a required file include fail if the file assigns no keys,
+// directly or through its own includes, which catches truncated generated files. Optional
+// includes are exempt
+func SetRequireNonEmptyIncludes(enabled bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	requireNonEmptyIncludes = enabled
+}
+
 // handleFileInclude processes a single file include
-func handleFileInclude(file string, required bool, currentFile string) error {
+func handleFileInclude(file string, required bool, currentFile string, always bool) error {
 	if !filepath.IsAbs(file) {
 		file = filepath.Join(filepath.Dir(currentFile), file)
 	}
 
-	err := loadFile(file)
+	// A file that was already loaded is skipped, so it can't be checked for keys again
+	mutex.RLock()
+	checkEmpty := required && requireNonEmptyIncludes && (always || !loadedFiles[file])
+	mutex.RUnlock()
+	before := parsedKeys.Load()
+
+	err := loadFile(file, always)
 	if err != nil {
 		if required {
 			return fmt.Errorf("failed to include required file %s: %w", file, err)
 		}
 		// Log warning for optional includes
-		fmt.Printf("Warning: Optional include file not found: %s\n", file)
+		warn("Optional include file not found: %s", file)
+		return nil
+	}
+
+	if checkEmpty && parsedKeys.Load() == before {
+		return fmt.Errorf("required include %s contains no keys", file)
+	}
+
+	recordInclude(currentFile, file)
+	return nil
+}
+
+// handleJSONInclude processes a JSON file include, flattening it into dotted keys
+func handleJSONInclude(file string, required bool, currentFile string) error {
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(filepath.Dir(currentFile), file)
+	}
+
+	if err := loadJSONFile(file); err != nil {
+		if required {
+			return fmt.Errorf("failed to include required JSON file %s: %w", file, err)
+		}
+		warn("Optional include JSON file not found: %s", file)
+		return nil
+	}
+
+	recordInclude(currentFile, file)
+	return nil
+}
+
+// handlePropertiesInclude processes a Java-style .properties file include
+func handlePropertiesInclude(file string, required bool, currentFile string) error {
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(filepath.Dir(currentFile), file)
+	}
+
+	if err := loadPropertiesFile(file); err != nil {
+		if required {
+			return fmt.Errorf("failed to include required properties file %s: %w", file, err)
+		}
+		warn("Optional include properties file not found: %s", file)
 		return nil
 	}
 
+	recordInclude(currentFile, file)
 	return nil
 }
 
 // handleURLInclude processes URL includes (placeholder for future implementation)
-func handleURLInclude(urlStr string, required bool) error {
+func handleURLInclude(urlStr string, required bool, currentFile string) error {
 	parsedURL, err := url.Parse(urlStr)
 	if err != nil {
 		if required {
@@ -59,47 +569,79 @@ func handleURLInclude(urlStr string, required bool) error {
 		return nil
 	}
 
-	client := &http.Client{
-		Timeout: 30 * time.Second,
+	if err := checkIncludeHost(parsedURL); err != nil {
+		if required {
+			return fmt.Errorf("failed to fetch URL %s: %w", urlStr, err)
+		}
+
+		return nil
 	}
 
-	resp, err := client.Get(urlStr)
+	resp, cancel, err := fetchURL(urlStr)
 	if err != nil {
+		if cached, err := loadURLCache(urlStr, err, currentFile); cached {
+			return err
+		}
+
 		if required {
-			return fmt.Errorf("failed to fetch URL %s: %w", urlStr, err)
+			return fmt.Errorf("%w %s: %w", ErrURLFetch, urlStr, err)
 		}
 
 		return nil
 	}
 
+	defer cancel()
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
+		fetchErr := fmt.Errorf("%w %s: status code %d", ErrURLFetch, urlStr, resp.StatusCode)
+		if cached, err := loadURLCache(urlStr, fetchErr, currentFile); cached {
+			return err
+		}
+
 		if required {
-			return fmt.Errorf("failed to fetch URL %s: status code %d", urlStr, resp.StatusCode)
+			return fetchErr
 		}
 
 		return nil
 	}
 
-	scanner := bufio.NewScanner(resp.Body)
-	var keyStack []string
-	lineNum := 0
+	enc, err := contentTypeEncoding(resp.Header.Get("Content-Type"))
+	if err != nil {
+		if required {
+			return fmt.Errorf("failed to decode URL %s: %w", urlStr, err)
+		}
 
-	for scanner.Scan() {
-		lineNum++
-		line := strings.TrimSpace(scanner.Text())
+		return nil
+	}
 
-		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
-			continue
-		}
+	if modified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		recordModTime(modified)
+	}
 
-		if err := parseLine(line, &keyStack, urlStr, lineNum); err != nil {
+	// The decoded content is cached so the copy can be parsed without the response headers
+	data, err := io.ReadAll(decodeReader(resp.Body, enc))
+	if err != nil {
+		fetchErr := fmt.Errorf("%w %s: %w", ErrURLFetch, urlStr, err)
+		if cached, err := loadURLCache(urlStr, fetchErr, currentFile); cached {
 			return err
 		}
+
+		if required {
+			return fetchErr
+		}
+
+		return nil
 	}
+	writeURLCache(urlStr, data)
+
+	recordInclude(currentFile, urlStr)
+
+	// The timeout only applies to this fetch, not to includes in the fetched config
+	previous := swapIncludeTimeout(0)
+	defer swapIncludeTimeout(previous)
 
-	return scanner.Err()
+	return parseReader(bytes.NewReader(data), urlStr)
 }
 
 // handleDirectoryInclude processes directory includes
@@ -108,57 +650,234 @@ func handleDirectoryInclude(dir string, required bool, currentFile string) error
 		dir = filepath.Join(filepath.Dir(currentFile), dir)
 	}
 
-	files, err := os.ReadDir(dir)
+	files, err := listConfigFiles(dir, false)
 	if err != nil {
 		if required {
 			return fmt.Errorf("failed to read directory %s: %w", dir, err)
 		}
-		fmt.Printf("Warning: Optional include directory not found: %s\n", dir)
+		warn("Optional include directory not found: %s", dir)
 		return nil
 	}
 
+	for _, filePath := range files {
+		if err := loadByExtension(filePath); err != nil {
+			if required {
+				return fmt.Errorf("failed to include file %s from directory: %w", filePath, err)
+			}
+
+			warn("Failed to include optional file %s: %v", filePath, err)
+			continue
+		}
+
+		recordInclude(currentFile, filePath)
+	}
+
+	return nil
+}
+
+// listConfigFiles returns the config files in dir that LoadDir and include directory(...) load,
+// those with a .conf, .hocon, .json or .properties extension, in the include sort order
+func listConfigFiles(dir string, recursive bool) ([]string, error) {
+	files, err := listConfigDir(dir, recursive)
+	if err != nil {
+		return nil, err
+	}
+
+	var configFiles []string
 	for _, file := range files {
-		if file.IsDir() {
+		switch strings.ToLower(filepath.Ext(file)) {
+		case ".conf", ".hocon", ".json", ".properties":
+			configFiles = append(configFiles, file)
+		}
+	}
+
+	return configFiles, nil
+}
+
+// listConfigDir returns the paths of the files in dir in the include sort order, descending
+// into subdirectories in the same order if recursive is set
+func listConfigDir(dir string, recursive bool) ([]string, error) {
+	entries, err := readConfigDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(entries))
+	isDir := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+		isDir[entry.Name()] = entry.IsDir()
+	}
+	sortIncludeNames(names)
+
+	var files []string
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		if !isDir[name] {
+			files = append(files, path)
 			continue
 		}
 
-		filePath := filepath.Join(dir, file.Name())
-		if err := loadFile(filePath); err != nil {
-			if required {
-				return fmt.Errorf("failed to include file %s from directory: %w", filePath, err)
+		if recursive {
+			nested, err := listConfigDir(path, true)
+			if err != nil {
+				return nil, err
 			}
+			files = append(files, nested...)
+		}
+	}
+
+	return files, nil
+}
+
+// GlobBase selects what relative glob include patterns are resolved against
+type GlobBase int
+
+const (
+	// GlobBaseFile resolves patterns against the directory of the including file
+	GlobBaseFile GlobBase = iota
+
+	// GlobBaseCwd resolves patterns against the process working directory
+	GlobBaseCwd
+)
 
-			fmt.Printf("Warning: Failed to include optional file %s: %v\n", filePath, err)
+// globBase is the base relative glob include patterns are resolved against
+var globBase = GlobBaseFile
+
+// SetGlobBase sets what relative glob include patterns are resolved against. The default,
+// GlobBaseFile, uses the directory of the including file. A single pattern can be resolved
+// against the working directory regardless of this setting with a "cwd:" prefix
+func SetGlobBase(base GlobBase) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	globBase = base
+}
+
+// IncludeSort selects the order files from directory and glob includes are loaded in
+type IncludeSort int
+
+const (
+	// IncludeSortLexical orders files byte by byte, so v10.conf comes before v2.conf
+	IncludeSortLexical IncludeSort = iota
+
+	// IncludeSortNatural compares runs of digits by their numeric value, so v2.conf comes before v10.conf
+	IncludeSortNatural
+)
+
+// includeSort is the order files from directory and glob includes are loaded in
+var includeSort = IncludeSortLexical
+
+// SetIncludeSort sets the order files from directory and glob includes, LoadDir and
+// LoadDirRecursive are loaded in, and so which file overrides which. The default,
+// IncludeSortLexical, sorts by name byte by byte
+func SetIncludeSort(order IncludeSort) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	includeSort = order
+}
+
+// sortIncludeNames sorts names in the configured include order
+func sortIncludeNames(names []string) {
+	mutex.RLock()
+	order := includeSort
+	mutex.RUnlock()
+
+	if order == IncludeSortNatural {
+		sort.SliceStable(names, func(i, j int) bool {
+			return naturalLess(names[i], names[j])
+		})
+		return
+	}
+
+	sort.Strings(names)
+}
+
+// naturalLess compares a and b with runs of digits compared by their numeric value. Names that
+// only differ in leading zeros fall back to a byte comparison so the order stays total
+func naturalLess(a, b string) bool {
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if !isDigit(a[i]) || !isDigit(b[j]) {
+			if a[i] != b[j] {
+				return a[i] < b[j]
+			}
+			i++
+			j++
+			continue
+		}
+
+		startA, startB := i, j
+		for i < len(a) && isDigit(a[i]) {
+			i++
+		}
+		for j < len(b) && isDigit(b[j]) {
+			j++
+		}
+
+		numA := strings.TrimLeft(a[startA:i], "0")
+		numB := strings.TrimLeft(b[startB:j], "0")
+		if len(numA) != len(numB) {
+			return len(numA) < len(numB)
+		}
+		if numA != numB {
+			return numA < numB
 		}
 	}
 
-	return nil
+	if len(a)-i != len(b)-j {
+		return len(a)-i < len(b)-j
+	}
+	return a < b
+}
+
+// isDigit reports whether c is an ASCII digit
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
 }
 
 // handleGlobInclude processes glob pattern includes
 func handleGlobInclude(pattern string, required bool, currentFile string) error {
-	if !filepath.IsAbs(pattern) {
+	mutex.RLock()
+	base := globBase
+	mutex.RUnlock()
+
+	if rest, ok := strings.CutPrefix(pattern, "cwd:"); ok {
+		pattern = rest
+	} else if !filepath.IsAbs(pattern) && base == GlobBaseFile {
 		pattern = filepath.Join(filepath.Dir(currentFile), pattern)
 	}
 
-	matches, err := filepath.Glob(pattern)
+	matches, err := globConfigFiles(pattern)
 	if err != nil {
 		if required {
 			return fmt.Errorf("invalid glob pattern %s: %w", pattern, err)
 		}
-		fmt.Printf("Warning: Invalid optional glob pattern: %s\n", pattern)
+		warn("Invalid optional glob pattern: %s", pattern)
 		return nil
 	}
 
 	if len(matches) == 0 && required {
-		return fmt.Errorf("no files found matching required pattern: %s", pattern)
+		return fmt.Errorf("%w: no files found matching required pattern: %s", ErrFileNotFound, pattern)
 	}
+	sortIncludeNames(matches)
 
 	for _, match := range matches {
-		if err := loadFile(match); err != nil && required {
-			return fmt.Errorf("failed to include file %s from glob: %w", match, err)
+		if err := loadFile(match, false); err != nil {
+			if required {
+				return fmt.Errorf("failed to include file %s from glob: %w", match, err)
+			}
+			continue
 		}
+
+		recordInclude(currentFile, match)
 	}
 
 	return nil
 }
+
+// recordInclude adds an edge from the including file to the included source
+func recordInclude(parent, child string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	includeGraph[parent] = append(includeGraph[parent], child)
+}
@@ -0,0 +1,41 @@
+package hoconenv
+
+import "strings"
+
+// lazyLoaders holds loaders registered with RegisterLazy that have not run yet
+var lazyLoaders = make(map[string]func() error)
+
+// RegisterLazy defers loading of the config section under keyPrefix until a key in that
+// section is first read through an accessor. The loader runs at most once
+func RegisterLazy(keyPrefix string, loader func() error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	lazyLoaders[strings.TrimSuffix(keyPrefix, ".")] = loader
+}
+
+// runLazyLoaders invokes and removes any pending loader whose section contains key
+func runLazyLoaders(key string) {
+	mutex.Lock()
+	if len(lazyLoaders) == 0 {
+		mutex.Unlock()
+		return
+	}
+
+	key = stripPrefix(key)
+
+	var pending []func() error
+	for section, loader := range lazyLoaders {
+		if key == section || strings.HasPrefix(key, section+".") {
+			pending = append(pending, loader)
+			delete(lazyLoaders, section)
+		}
+	}
+	mutex.Unlock()
+
+	// Loaders usually call Load, so they must run without holding the lock
+	for _, loader := range pending {
+		if err := loader(); err != nil {
+			warn("Lazy loader for key %s failed: %v", key, err)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package hoconenv
+
+import (
+	"io/fs"
+	"time"
+)
+
+// lastModified is the most recent modification time among the loaded sources
+var lastModified time.Time
+
+// LastModified returns the most recent modification time among all loaded files, including
+// included files, or of the Last-Modified header of URL includes that send one. It is
+// recorded while loading, so calling it is cheap. It returns the zero time if nothing with a
+// modification time was loaded
+func LastModified() time.Time {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return lastModified
+}
+
+// recordFileModTime records the modification time of an opened config file
+func recordFileModTime(file interface{ Stat() (fs.FileInfo, error) }) {
+	if info, err := file.Stat(); err == nil {
+		recordModTime(info.ModTime())
+	}
+}
+
+// recordModTime raises lastModified to t if it is more recent
+func recordModTime(t time.Time) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if t.After(lastModified) {
+		lastModified = t
+	}
+}
@@ -0,0 +1,55 @@
+package hoconenv
+
+import (
+	"fmt"
+	"strings"
+)
+
+var (
+	trackOrigins = false
+	origins      = make(map[string]string)
+)
+
+// SetTrackOrigins enables recording the file and line that set each key, as reported by Origin.
+// Tracking is off by default to avoid the overhead
+func SetTrackOrigins(enabled bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	trackOrigins = enabled
+}
+
+// Origin returns the location ("file:line") of the assignment that produced the current value
+// of key, or an empty string if the key is unknown or origin tracking is disabled
+func Origin(key string) string {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	if stored, exists := canonicalKey(key); exists {
+		return origins[strings.ToLower(stored)]
+	}
+	return ""
+}
+
+// GetWithOrigin returns the value of key together with the location ("file:line") it was
+// assigned at, for tools that show where configuration comes from. The origin is empty if
+// origin tracking is disabled, while the value and ok behave like the other getters
+func GetWithOrigin(key string) (value string, origin string, ok bool) {
+	value, ok = lookupValue(key)
+	if !ok {
+		return "", "", false
+	}
+
+	return value, Origin(key), true
+}
+
+// recordOrigin remembers where the winning value for key was assigned. The caller must hold the mutex
+func recordOrigin(key, origin string) {
+	if trackOrigins && origin != "" {
+		origins[strings.ToLower(key)] = origin
+	}
+}
+
+// location formats a file and line number as an origin
+func location(filePath string, lineNum int) string {
+	return fmt.Sprintf("%s:%d", filePath, lineNum)
+}
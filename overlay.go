@@ -0,0 +1,117 @@
+package hoconenv
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// includeFS is consulted before the OS filesystem when config files are read by path
+var includeFS fs.FS
+
+// SetIncludeFS sets a filesystem that is consulted before the OS filesystem whenever a config
+// file, directory or glob is read by path, including files pulled in by include. Paths are
+// looked up in fsys relative to its root, so /etc/app/base.conf maps to etc/app/base.conf.
+// Anything missing from fsys is read from disk. Passing nil restores plain OS behavior
+func SetIncludeFS(fsys fs.FS) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	includeFS = fsys
+}
+
+// overlayName returns the overlay filesystem and the name path maps to inside it
+func overlayName(path string) (fs.FS, string, bool) {
+	mutex.RLock()
+	fsys := includeFS
+	mutex.RUnlock()
+
+	if fsys == nil {
+		return nil, "", false
+	}
+
+	name := strings.TrimPrefix(filepath.ToSlash(filepath.Clean(path)), "/")
+	if !fs.ValidPath(name) {
+		return nil, "", false
+	}
+
+	return fsys, name, true
+}
+
+// openConfigFile opens path from the overlay if it exists there, otherwise from disk, and records
+// it as read by the current load
+func openConfigFile(path string) (io.ReadCloser, error) {
+	file, err := openPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	openedFiles.Add(1)
+	recordFileModTime(file)
+	return file, nil
+}
+
+// openPath opens path from the overlay if it exists there, otherwise from disk
+func openPath(path string) (fs.File, error) {
+	if fsys, name, ok := overlayName(path); ok {
+		file, err := fsys.Open(name)
+		if err == nil {
+			return file, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// readConfigFile reads the whole file at path, preferring the overlay
+func readConfigFile(path string) ([]byte, error) {
+	file, err := openConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return io.ReadAll(file)
+}
+
+// readConfigDir lists dir from the overlay if it exists there, otherwise from disk
+func readConfigDir(dir string) ([]fs.DirEntry, error) {
+	if fsys, name, ok := overlayName(dir); ok {
+		if entries, err := fs.ReadDir(fsys, name); err == nil {
+			return entries, nil
+		}
+	}
+
+	return os.ReadDir(dir)
+}
+
+// globConfigFiles matches pattern against the overlay, falling back to disk if nothing matches there
+func globConfigFiles(pattern string) ([]string, error) {
+	if fsys, name, ok := overlayName(pattern); ok {
+		matches, err := fs.Glob(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(matches) > 0 {
+			for i, match := range matches {
+				matches[i] = filepath.FromSlash(match)
+				if filepath.IsAbs(pattern) {
+					matches[i] = string(filepath.Separator) + matches[i]
+				}
+			}
+			return matches, nil
+		}
+	}
+
+	return filepath.Glob(pattern)
+}
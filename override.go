@@ -0,0 +1,53 @@
+package hoconenv
+
+import (
+	"os"
+	"strings"
+	"sync"
+)
+
+// Override sets key to value in the configuration and the environment,
+// and returns a function that restores the exact previous state, including the key being unset.
+// It is meant for tests: defer the returned function to undo the override. Calling it more
+// than once has no further effect. Since it always undoes itself, it also works after Freeze,
+// so tests can exercise a service that froze its configuration at startup
+func Override(key, value string) (restore func()) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	stored, existed := canonicalKey(key)
+	if !existed {
+		// A new key is stored like a parsed one, without the prefix
+		stored = stripPrefix(key)
+		if keyCasePolicy == KeyCaseLowerAll {
+			stored = strings.ToLower(stored)
+		}
+	}
+
+	previous, previousArray := variables[stored], arrayKeys[stored]
+	name := envName(stored)
+	previousEnv, envExisted := os.LookupEnv(name)
+
+	storeValue(stored, value, false)
+	os.Setenv(name, value)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			if existed {
+				storeValue(stored, previous, previousArray)
+			} else {
+				deleteValue(stored)
+			}
+
+			if envExisted {
+				os.Setenv(name, previousEnv)
+			} else {
+				os.Unsetenv(name)
+			}
+		})
+	}
+}
@@ -0,0 +1,30 @@
+package hoconenv
+
+import "fmt"
+
+// loadParent loads the parent file named by an @parent "file" directive, so the rest of the
+// current file overrides it. A parent must be declared at the top level before the file assigns
+// any keys, and several parents layer in order. Parents are loaded even if they were loaded
+// before, which also makes an inheritance cycle fail
+func (s *parseState) loadParent(value, filePath string, lineNum int) error {
+	if len(s.keyStack) != s.inherited {
+		return markError(ErrSyntax, fmt.Errorf("@parent must be declared at the top level at %s:%d", filePath, lineNum))
+	}
+	if s.assigned {
+		return markError(ErrSyntax, fmt.Errorf("@parent must be declared before other keys at %s:%d", filePath, lineNum))
+	}
+
+	file := processValue(value)
+	if file == "" {
+		return markError(ErrSyntax, fmt.Errorf("empty @parent at %s:%d", filePath, lineNum))
+	}
+
+	if s.handler != nil {
+		return s.streamFile(file, true, filePath)
+	}
+
+	err := s.includeWith(func() error {
+		return handleFileInclude(file, true, filePath, true)
+	})
+	return markError(ErrIncludeFailed, err)
+}
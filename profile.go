@@ -0,0 +1,36 @@
+package hoconenv
+
+import "strings"
+
+// activeProfile is the profile whose blocks are applied during the load in progress; keys in
+// other profile blocks are skipped
+var activeProfile = ""
+
+// LoadProfile loads configuration like Load, applying only the profile "name" { ... } blocks
+// that match name. Keys outside any profile block are always applied
+func LoadProfile(name string, files ...string) error {
+	return load(loadOptions{profile: name}, files...)
+}
+
+// profileName returns the profile name if blockKey opens a profile block
+func profileName(blockKey string) (string, bool) {
+	if !strings.HasPrefix(blockKey, "profile ") {
+		return "", false
+	}
+
+	return strings.Trim(strings.TrimSpace(strings.TrimPrefix(blockKey, "profile")), "\"'"), true
+}
+
+// inInactiveProfile reports whether the key stack is inside a profile block that isn't selected
+func inInactiveProfile(keyStack []string) bool {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	for _, blockKey := range keyStack {
+		if name, ok := profileName(blockKey); ok && name != activeProfile {
+			return true
+		}
+	}
+
+	return false
+}
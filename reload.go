@@ -0,0 +1,135 @@
+package hoconenv
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ReloadFile re-parses a single loaded file and merges it into the configuration, which is
+// cheaper than reloading every file when only one changed. Keys whose value came from the file
+// are removed first, so keys it no longer sets disappear, along with their environment
+// variables, while keys from other files are kept. It relies on origin tracking to know which
+// keys came from the file, so SetTrackOrigins must be enabled before the first load.
+//
+// Keys that a file loaded after this one had overridden keep their value. A key the file had
+// overridden is removed rather than restored to the earlier value, and substitutions in other files that reference the file's keys keep their resolved values.
+// Reload everything with Reset and Load when either matters. If the reload fails, the
+// configuration is left as it was.
+//
+// Only files passed to Load or LoadDir can be reloaded. Included files and files loaded with
+// LoadProfile, LoadFragments, LoadFiltered or LoadWithData were parsed in a context that a
+// reload wouldn't restore, so they return an error
+func ReloadFile(path string) error {
+	mutex.RLock()
+	tracking := trackOrigins
+	loaded := loadedFiles[path]
+	reloadable := reloadableFiles[path]
+	mutex.RUnlock()
+
+	if !tracking {
+		return fmt.Errorf("ReloadFile requires origin tracking, enable it with SetTrackOrigins before loading")
+	}
+	if !loaded {
+		return fmt.Errorf("cannot reload %s, it was not loaded", path)
+	}
+	if !reloadable {
+		return fmt.Errorf("cannot reload %s, it was included or loaded with per-load options, reload the file that loaded it instead", path)
+	}
+
+	var stale map[string]string
+	err := atomicLoad(func() error {
+		mutex.Lock()
+		stale = removeFileKeys(path)
+		protectLaterKeys(path)
+		delete(loadedFiles, path)
+		mutex.Unlock()
+
+		return loadByExtension(path)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Variables of keys the file no longer sets are removed from the environment
+	mutex.RLock()
+	defer mutex.RUnlock()
+	for key, name := range stale {
+		if _, exists := variables[key]; !exists {
+			os.Unsetenv(name)
+		}
+	}
+
+	return nil
+}
+
+// reloadableFiles holds the files ReloadFile can parse again: those loaded directly by Load
+var reloadableFiles = make(map[string]bool)
+
+// loadOrder holds the position of each loaded file in the order the files were first loaded
+var loadOrder = make(map[string]int)
+
+// markLoaded records that file was loaded, keeping its original position when it is reloaded.
+// The caller must hold the mutex
+func markLoaded(file string) {
+	loadedFiles[file] = true
+	if _, exists := loadOrder[file]; !exists {
+		loadOrder[file] = len(loadOrder)
+	}
+}
+
+// protectLaterKeys gives the keys whose value came from a file loaded after path a priority no
+// assignment can beat during the reload of path, so the file can't override them again. The
+// caller must hold the mutex
+func protectLaterKeys(path string) {
+	for key := range variables {
+		position, exists := loadOrder[originFile(origins[strings.ToLower(key)])]
+		if exists && position > loadOrder[path] {
+			keyPriority[key] = math.MaxInt
+		}
+	}
+}
+
+// markReloadable records that Load parsed file directly. Files loaded while a per-load option
+// such as a profile or key filter is active are left out, as a reload wouldn't apply it
+func markReloadable(file string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if activeProfile == "" && activeFragments == nil && keyFilter == nil && templateData == nil {
+		reloadableFiles[file] = true
+	}
+}
+
+// removeFileKeys removes the keys whose value came from path and returns the environment
+// variable names they were applied to. The caller must hold the mutex
+func removeFileKeys(path string) map[string]string {
+	removed := make(map[string]string)
+	for key := range variables {
+		lower := strings.ToLower(key)
+		if originFile(origins[lower]) != path {
+			continue
+		}
+
+		removed[key] = envName(key)
+		deleteValue(key)
+		delete(origins, lower)
+	}
+
+	return removed
+}
+
+// originFile returns the file of an origin, without the line number if it has one
+func originFile(origin string) string {
+	i := strings.LastIndexByte(origin, ':')
+	if i == -1 {
+		return origin
+	}
+
+	if _, err := strconv.Atoi(origin[i+1:]); err != nil {
+		return origin
+	}
+	return origin[:i]
+}
@@ -0,0 +1,36 @@
+package hoconenv
+
+import "strings"
+
+// includePrefixes holds the prefix blocks enclosing the include currently being loaded
+var includePrefixes []string
+
+// prefixBlockName returns the prefix if blockKey opens a prefix "name" { ... } block
+func prefixBlockName(blockKey string) (string, bool) {
+	if !strings.HasPrefix(blockKey, "prefix ") {
+		return "", false
+	}
+
+	return strings.Trim(strings.TrimSpace(strings.TrimPrefix(blockKey, "prefix")), "\"'"), true
+}
+
+// prefixBlocks returns the prefix blocks enclosing the current position, including inherited ones
+func (s *parseState) prefixBlocks() []string {
+	var blocks []string
+	for _, blockKey := range s.keyStack {
+		if _, ok := prefixBlockName(blockKey); ok {
+			blocks = append(blocks, blockKey)
+		}
+	}
+	return blocks
+}
+
+// swapIncludePrefixes sets the prefix blocks inherited by included files and returns the previous ones
+func swapIncludePrefixes(blocks []string) []string {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	previous := includePrefixes
+	includePrefixes = blocks
+	return previous
+}
@@ -0,0 +1,51 @@
+package hoconenv
+
+import (
+	"fmt"
+	"strings"
+)
+
+// redacted replaces the value of secret keys in exported output
+const redacted = "***"
+
+// secrets holds the normalized keys whose values are redacted in exported output
+var secrets = make(map[string]bool)
+
+// MarkSecret marks keys as secret. Their values stay available through the accessors and the
+// environment, and WriteFile writes them as they are, but Export, DumpSorted and Diff show "***" instead
+func MarkSecret(keys ...string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for _, key := range keys {
+		secrets[stripPrefix(strings.ToLower(key))] = true
+	}
+}
+
+// handleSecret marks the key named by a secret directive, relative to the enclosing blocks
+func handleSecret(line string, keyStack []string, filePath string, lineNum int) error {
+	key := strings.TrimSpace(strings.TrimPrefix(line, "secret"))
+	key = strings.Trim(stripInlineComment(key), "\"'")
+
+	if key == "" {
+		return fmt.Errorf("%w at %s:%d: %s", ErrSyntax, filePath, lineNum, line)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	secrets[strings.ToLower(buildFullKey(keyStack, key))] = true
+
+	return nil
+}
+
+// redactSecrets replaces the values of secret keys in a snapshot keyed without the prefix
+func redactSecrets(snapshot map[string]string) {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	for key := range snapshot {
+		if secrets[strings.ToLower(key)] {
+			snapshot[key] = redacted
+		}
+	}
+}
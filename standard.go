@@ -0,0 +1,73 @@
+package hoconenv
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// standardFileName is the file looked up in every standard search directory
+const standardFileName = "application.conf"
+
+// standardSearchPaths overrides the directories searched by LoadStandard when non-nil
+var standardSearchPaths []string
+
+// SetStandardSearchPaths overrides the directories searched by LoadStandard, in increasing order
+// of precedence. "{app}" in a directory is replaced with the application name. Calling it with
+// no directories restores the default search path
+func SetStandardSearchPaths(dirs ...string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if len(dirs) == 0 {
+		standardSearchPaths = nil
+		return
+	}
+	standardSearchPaths = append([]string(nil), dirs...)
+}
+
+// LoadStandard loads application.conf from the standard locations for appName: /etc/<app>,
+// $XDG_CONFIG_HOME/<app> (or ~/.config/<app>) and the working directory, with later files
+// overriding earlier ones. Missing files are skipped, but at least one must exist
+func LoadStandard(appName string) error {
+	var files []string
+	dirs := standardDirs(appName)
+	for _, dir := range dirs {
+		path := filepath.Join(dir, standardFileName)
+		if _, err := os.Stat(path); err == nil {
+			files = append(files, path)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to check config file %s: %w", path, err)
+		}
+	}
+
+	if len(files) == 0 {
+		return fmt.Errorf("no %s found for %s in %s", standardFileName, appName, strings.Join(dirs, ", "))
+	}
+
+	return Load(files...)
+}
+
+// standardDirs returns the directories LoadStandard searches for appName
+func standardDirs(appName string) []string {
+	mutex.RLock()
+	dirs := standardSearchPaths
+	mutex.RUnlock()
+
+	if dirs == nil {
+		dirs = []string{filepath.Join("/etc", "{app}")}
+		if configDir, err := os.UserConfigDir(); err == nil {
+			dirs = append(dirs, filepath.Join(configDir, "{app}"))
+		}
+		dirs = append(dirs, ".")
+	}
+
+	expanded := make([]string, len(dirs))
+	for i, dir := range dirs {
+		expanded[i] = strings.ReplaceAll(dir, "{app}", appName)
+	}
+
+	return expanded
+}
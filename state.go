@@ -0,0 +1,152 @@
+package hoconenv
+
+import (
+	"maps"
+	"sync"
+	"time"
+)
+
+// loadMutex serializes whole loads, so a failed load can't roll back the changes of another
+// load running at the same time. It is taken before mutex
+var loadMutex sync.Mutex
+
+// loadState is a copy of everything a load can change, used to roll back a failed load
+type loadState struct {
+	variables         map[string]string
+	keyIndex          map[string]string
+	arrayKeys         map[string]bool
+	loadedFiles       map[string]bool
+	reloadableFiles   map[string]bool
+	loadOrder         map[string]int
+	includeGraph      map[string][]string
+	defaults          map[string]rawValue
+	pendingValues     map[string]rawValue
+	overriddenPending map[string][]rawValue
+	unresolved        map[string][]string
+	origins           map[string]string
+	history           map[string][]historyEntry
+	annotations       map[string]map[string]string
+	secrets           map[string]bool
+	envNames          map[string]string
+	lastModified      time.Time
+}
+
+// captureState copies the loaded configuration. The caller must hold the mutex
+func captureState() *loadState {
+	s := &loadState{
+		variables:         maps.Clone(variables),
+		keyIndex:          maps.Clone(keyIndex),
+		arrayKeys:         maps.Clone(arrayKeys),
+		loadedFiles:       maps.Clone(loadedFiles),
+		reloadableFiles:   maps.Clone(reloadableFiles),
+		loadOrder:         maps.Clone(loadOrder),
+		includeGraph:      make(map[string][]string, len(includeGraph)),
+		defaults:          maps.Clone(defaults),
+		pendingValues:     maps.Clone(pendingValues),
+		overriddenPending: make(map[string][]rawValue, len(overriddenPending)),
+		unresolved:        maps.Clone(unresolved),
+		origins:           maps.Clone(origins),
+		history:           make(map[string][]historyEntry, len(history)),
+		annotations:       make(map[string]map[string]string, len(annotations)),
+		secrets:           maps.Clone(secrets),
+		envNames:          maps.Clone(envNames),
+		lastModified:      lastModified,
+	}
+
+	// Slices and nested maps are appended to or updated in place, so they are copied too
+	for key, children := range includeGraph {
+		s.includeGraph[key] = append([]string(nil), children...)
+	}
+	for key, values := range overriddenPending {
+		s.overriddenPending[key] = append([]rawValue(nil), values...)
+	}
+	for key, entries := range history {
+		s.history[key] = append([]historyEntry(nil), entries...)
+	}
+	for key, values := range annotations {
+		s.annotations[key] = maps.Clone(values)
+	}
+
+	return s
+}
+
+// restoreState replaces the loaded configuration with s. The caller must hold the mutex
+func restoreState(s *loadState) {
+	variables = s.variables
+	keyIndex = s.keyIndex
+	arrayKeys = s.arrayKeys
+	loadedFiles = s.loadedFiles
+	reloadableFiles = s.reloadableFiles
+	loadOrder = s.loadOrder
+	includeGraph = s.includeGraph
+	defaults = s.defaults
+	pendingValues = s.pendingValues
+	overriddenPending = s.overriddenPending
+	unresolved = s.unresolved
+	origins = s.origins
+	history = s.history
+	annotations = s.annotations
+	secrets = s.secrets
+	envNames = s.envNames
+	lastModified = s.lastModified
+}
+
+// loadOptions are the settings that only apply to a single load
+type loadOptions struct {
+	filter    func(key string) bool // Keys to store, from LoadFiltered
+	profile   string                // Profile whose blocks are applied, from LoadProfile
+	fragments map[string]bool       // Fragments whose blocks are loaded, from LoadFragments
+	data      map[string]any        // Data values are rendered against, from LoadWithData
+}
+
+// install makes opts the options of the load in progress. The caller must hold loadMutex
+func (opts loadOptions) install() {
+	mutex.Lock()
+	defer mutex.Unlock()
+	keyFilter = opts.filter
+	activeProfile = opts.profile
+	activeFragments = opts.fragments
+	templateData = opts.data
+}
+
+// atomicLoad runs parse and finishes the load, restoring the previous configuration if either
+// fails, so a load either applies completely or leaves no trace. Loads run one at a time
+func atomicLoad(parse func() error) error {
+	return atomicLoadWith(loadOptions{}, parse)
+}
+
+// atomicLoadWith is atomicLoad with the options of the load. They are installed while holding
+// loadMutex, so they never leak into another load
+func atomicLoadWith(opts loadOptions, parse func() error) error {
+	loadMutex.Lock()
+	defer loadMutex.Unlock()
+
+	opts.install()
+	defer loadOptions{}.install()
+
+	mutex.RLock()
+	err := checkFrozen("load configuration")
+	mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	beginLoad()
+
+	mutex.Lock()
+	saved := captureState()
+	mutex.Unlock()
+
+	err = parse()
+	if err == nil {
+		err = finishLoad()
+	}
+
+	if err != nil {
+		mutex.Lock()
+		restoreState(saved)
+		mutex.Unlock()
+	}
+
+	return err
+}
@@ -0,0 +1,93 @@
+package hoconenv
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// Parse parses HOCON from r and calls handler with the full key and value of every assignment
+// as it is parsed, including those from included files, without storing anything or touching
+// the environment, so it can run alongside Load. Values are passed as written: quotes are
+// removed, but substitutions are not resolved and default assignments are passed like any
+// other. Only plain file includes, optionally marked required or optional, are followed; other
+// includes fail with ErrIncludeFailed. An error from handler stops parsing and is returned
+// as-is. The name is used in error messages and for relative includes
+func Parse(r io.Reader, name string, handler func(key, value string) error) error {
+	state := &parseState{
+		batch:    make(map[string]batchEntry),
+		handler:  handler,
+		streamed: map[string]bool{name: true},
+	}
+
+	return parseWith(decodeReader(r, configuredEncoding()), name, state)
+}
+
+// streamInclude follows an include while streaming with Parse
+func (s *parseState) streamInclude(spec, currentFile string) error {
+	includeStr := strings.TrimSpace(strings.TrimPrefix(spec, "include"))
+
+	required := true
+	if rest, ok := strings.CutPrefix(includeStr, "optional "); ok {
+		required, includeStr = false, strings.TrimSpace(rest)
+	} else if rest, ok := strings.CutPrefix(includeStr, "required "); ok {
+		includeStr = strings.TrimSpace(rest)
+	}
+
+	file, ok := plainIncludeFile(includeStr)
+	if !ok {
+		return fmt.Errorf("%w: Parse only follows plain file includes, got %q in %s", ErrIncludeFailed, spec, currentFile)
+	}
+
+	return s.streamFile(file, required, currentFile)
+}
+
+// plainIncludeFile returns the file named by a quoted include target that is neither a URL nor
+// a glob, nor has any other include options
+func plainIncludeFile(target string) (string, bool) {
+	if len(target) < 2 || (target[0] != '"' && target[0] != '\'') || target[len(target)-1] != target[0] {
+		return "", false
+	}
+
+	file := target[1 : len(target)-1]
+	if file == "" || strings.ContainsAny(file, "\"'*") || strings.Contains(file, "://") {
+		return "", false
+	}
+
+	return file, true
+}
+
+// streamFile parses file relative to currentFile with the same handler. Like Load, a file is
+// only parsed once per Parse call, which also stops include cycles
+func (s *parseState) streamFile(file string, required bool, currentFile string) error {
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(filepath.Dir(currentFile), file)
+	}
+
+	if s.streamed[file] {
+		return nil
+	}
+	s.streamed[file] = true
+
+	reader, err := openPath(file)
+	if err != nil {
+		if !required {
+			return nil
+		}
+		return markError(ErrIncludeFailed, fmt.Errorf("failed to include required file %s: %w", file, err))
+	}
+	defer reader.Close()
+
+	blocks := s.prefixBlocks()
+	child := &parseState{
+		keyStack:   blocks,
+		inherited:  len(blocks),
+		batch:      make(map[string]batchEntry),
+		inFragment: s.insideFragment(),
+		handler:    s.handler,
+		streamed:   s.streamed,
+	}
+
+	return parseWith(decodeReader(reader, configuredEncoding()), file, child)
+}
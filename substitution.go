@@ -0,0 +1,278 @@
+package hoconenv
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// rawValue is a parsed value that still has to be resolved, or a default waiting to be applied
+type rawValue struct {
+	value      string    // Literal value, or the raw text when substitute is set
+	scope      []string  // Object path the value was declared in
+	substitute bool      // Whether value contains substitutions to resolve
+	origin     string    // Location of the assignment
+	priority   int       // Include priority of the file the value came from
+	history    int       // Index of the reserved history entry, or -1
+	appended   bool      // Whether value is an element appended with +=
+	base       *rawValue // Pending assignment an append builds on, if any
+	array      bool      // Whether value was written as an unquoted array literal
+}
+
+var (
+	// pendingValues holds assignments whose substitutions are resolved once all files are parsed
+	pendingValues = make(map[string]rawValue)
+
+	// unresolved holds the undefined substitution paths left in each key's current value
+	unresolved = make(map[string][]string)
+)
+
+// containsSubstitution reports whether value has a ${...} substitution outside of quotes
+func containsSubstitution(value string) bool {
+	inQuotes := false
+	for i := 0; i < len(value); i++ {
+		switch {
+		case value[i] == '"':
+			inQuotes = !inQuotes
+		case !inQuotes && strings.HasPrefix(value[i:], "${"):
+			return true
+		}
+	}
+	return false
+}
+
+// resolveSubstitutions resolves ${path} and ${?path} references in value and concatenates
+// the result with any quoted or unquoted text around them. Quoted text is kept literally,
+// and outside quotes $${ is an escape for a literal ${.
+//
+// A path is resolved relative to the enclosing objects in scope first, innermost to
+// outermost, then as a full path from the root, and finally as a process environment
+// variable. Inside server { db { ... } }, ${host} tries server.db.host, server.host, host
+// and then the HOST env var.
+//
+// An undefined ${path} is left in place and its path is returned in missing, while an
+// undefined ${?path} resolves to an empty string. When the whole value is a single undefined
+// ${?path}, the returned bool is false so the caller can leave the key unset and keep any
+// earlier value.
+//
+// The caller must hold the mutex; visiting tracks the keys being resolved to break cycles
+func resolveSubstitutions(value string, scope []string, visiting map[string]bool) (resolved string, missing []string, ok bool) {
+	var result strings.Builder
+	tokens, undefinedOptional := 0, 0
+
+	for i := 0; i < len(value); {
+		switch {
+		case value[i] == '"':
+			end := strings.IndexByte(value[i+1:], '"')
+			if end == -1 {
+				result.WriteString(value[i:])
+				i = len(value)
+				continue
+			}
+			result.WriteString(value[i+1 : i+1+end])
+			i += end + 2
+			tokens++
+
+		case strings.HasPrefix(value[i:], "$${"):
+			// An escaped $${ is kept as a literal ${ and the text after it isn't resolved
+			result.WriteString("${")
+			i += 3
+			tokens++
+
+		case strings.HasPrefix(value[i:], "${"):
+			end := strings.IndexByte(value[i:], '}')
+			if end == -1 {
+				result.WriteString(value[i:])
+				i = len(value)
+				continue
+			}
+
+			ref := value[i+2 : i+end]
+			optional := strings.HasPrefix(ref, "?")
+			path := strings.TrimSpace(strings.TrimPrefix(ref, "?"))
+
+			var resolved string
+			var ok bool
+			if name, args, isCall, _ := parseFunctionCall(path); isCall {
+				resolved, ok = callFunction(name, args)
+			} else {
+				resolved, ok = lookupSubstitution(path, scope, visiting)
+			}
+
+			if ok {
+				result.WriteString(resolved)
+			} else if optional {
+				undefinedOptional++
+			} else {
+				result.WriteString(value[i : i+end+1])
+				missing = append(missing, path)
+			}
+
+			i += end + 1
+			tokens++
+
+		default:
+			if value[i] != ' ' && value[i] != '\t' {
+				tokens++
+			}
+			result.WriteByte(value[i])
+			i++
+		}
+	}
+
+	if tokens == 1 && undefinedOptional == 1 {
+		return "", nil, false
+	}
+
+	return strings.TrimSpace(result.String()), missing, true
+}
+
+// lookupSubstitution finds the value for a substitution path in the config or the environment,
+// resolving pending values it depends on first. The caller must hold the mutex
+func lookupSubstitution(path string, scope []string, visiting map[string]bool) (string, bool) {
+	value, _, ok := lookupSubstitutionKey(path, scope, visiting)
+	return value, ok
+}
+
+// lookupSubstitutionKey is lookupSubstitution that also reports whether the value is an
+// array. Environment variables are never arrays. The caller must hold the mutex
+func lookupSubstitutionKey(path string, scope []string, visiting map[string]bool) (string, bool, bool) {
+	for i := len(scope); i >= 0; i-- {
+		candidate := path
+		if i > 0 {
+			candidate = strings.Join(scope[:i], ".") + "." + path
+		}
+
+		// A key referencing itself sees its previous value rather than its pending one
+		if _, isPending := pendingValues[candidate]; isPending && !visiting[candidate] {
+			resolvePendingKey(candidate, visiting)
+		}
+
+		if value, exists := variables[candidate]; exists {
+			return value, arrayKeys[candidate], true
+		}
+
+		if stored, exists := keyIndex[strings.ToLower(candidate)]; exists {
+			return variables[stored], arrayKeys[stored], true
+		}
+	}
+
+	value, ok := os.LookupEnv(path)
+	return value, false, ok
+}
+
+// substitutesArray reports whether value is a single ${path} referencing an array, in which
+// case the resolved value is that array. The caller must hold the mutex
+func substitutesArray(value rawValue, visiting map[string]bool) bool {
+	ref, ok := strings.CutPrefix(value.value, "${")
+	if !ok || !strings.HasSuffix(ref, "}") || strings.Contains(ref, "${") {
+		return false
+	}
+
+	path := strings.TrimSpace(strings.TrimPrefix(strings.TrimSuffix(ref, "}"), "?"))
+	if _, _, isCall, _ := parseFunctionCall(path); isCall {
+		return false
+	}
+
+	_, array, _ := lookupSubstitutionKey(path, value.scope, visiting)
+	return array
+}
+
+// storePending records an assignment whose substitutions are resolved after parsing,
+// so it can reference keys from files that are loaded later
+func storePending(fullKey string, value rawValue) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if !acceptPriority(fullKey, value.priority) {
+		return
+	}
+
+	// An append builds on the pending assignment it replaces
+	if previous, exists := pendingValues[fullKey]; exists && value.appended {
+		value.base = &previous
+	}
+
+	overridePending(fullKey)
+	value.history = reserveHistory(fullKey)
+	pendingValues[fullKey] = value
+}
+
+// resolvePending resolves all pending assignments once every file has been parsed
+func resolvePending() {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	keys := make([]string, 0, len(pendingValues))
+	for key := range pendingValues {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	visiting := make(map[string]bool)
+	for _, key := range keys {
+		resolvePendingKey(key, visiting)
+	}
+
+	resolveOverriddenHistory()
+}
+
+// resolvePendingKey resolves a single pending assignment. The caller must hold the mutex
+func resolvePendingKey(key string, visiting map[string]bool) {
+	pending, exists := pendingValues[key]
+	if !exists {
+		return
+	}
+
+	visiting[key] = true
+	resolved, missing, ok, array := resolveRaw(key, pending, visiting)
+	delete(visiting, key)
+	delete(pendingValues, key)
+
+	// An undefined optional substitution keeps any earlier value
+	if ok {
+		recordUnresolved(key, missing)
+		storeValue(key, resolved, array)
+		recordOrigin(key, pending.origin)
+		resolveHistory(key, pending.history, resolved)
+	}
+}
+
+// recordUnresolved remembers the undefined substitutions left in key's value. The caller must hold the mutex
+func recordUnresolved(key string, missing []string) {
+	if len(missing) == 0 {
+		delete(unresolved, key)
+		return
+	}
+	unresolved[key] = missing
+	recordWarning("Unresolved substitution in %s: ${%s}", key, strings.Join(missing, "}, ${"))
+}
+
+// CheckResolved returns an error listing every key whose value still contains a ${path}
+// substitution that could not be resolved. Optional ${?path} substitutions are never reported
+func CheckResolved() error {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	if len(unresolved) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(unresolved))
+	for key := range unresolved {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	problems := make([]string, len(keys))
+	for i, key := range keys {
+		refs := make([]string, len(unresolved[key]))
+		for j, path := range unresolved[key] {
+			refs[j] = "${" + path + "}"
+		}
+		problems[i] = fmt.Sprintf("%s (%s)", key, strings.Join(refs, ", "))
+	}
+
+	return fmt.Errorf("unresolved substitutions: %s", strings.Join(problems, ", "))
+}
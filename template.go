@@ -0,0 +1,56 @@
+package hoconenv
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// templateData is the data values are rendered against during a LoadWithData load, or nil when templating is off
+var templateData map[string]any
+
+// LoadWithData loads configuration like Load and then renders every value containing "{{" as a
+// text/template against data, e.g. greeting = "Hello {{.User}}". Substitutions are resolved
+// first, so a template can use their results. Referencing a missing data key is an error
+func LoadWithData(data map[string]any, files ...string) error {
+	if data == nil {
+		data = map[string]any{}
+	}
+
+	return load(loadOptions{data: data}, files...)
+}
+
+// renderTemplates renders the template values of the current load against templateData
+func renderTemplates() error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if templateData == nil {
+		return nil
+	}
+
+	keys := make([]string, 0, len(variables))
+	for key, value := range variables {
+		if strings.Contains(value, "{{") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		tmpl, err := template.New(key).Option("missingkey=error").Parse(variables[key])
+		if err != nil {
+			return fmt.Errorf("invalid template in key %s: %w", key, err)
+		}
+
+		var rendered strings.Builder
+		if err := tmpl.Execute(&rendered, templateData); err != nil {
+			return fmt.Errorf("failed to render template in key %s: %w", key, err)
+		}
+
+		variables[key] = rendered.String()
+	}
+
+	return nil
+}
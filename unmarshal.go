@@ -0,0 +1,375 @@
+package hoconenv
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// decoders converts config strings to types that setField can't handle, keyed by the field type
+var decoders = builtinDecoders()
+
+// builtinDecoders returns the decoders that are always available
+func builtinDecoders() map[reflect.Type]func(string) (interface{}, error) {
+	return map[reflect.Type]func(string) (interface{}, error){
+		reflect.TypeOf(time.Duration(0)): func(value string) (interface{}, error) {
+			return parseDuration(value)
+		},
+		reflect.TypeOf(url.URL{}): func(value string) (interface{}, error) {
+			u, err := url.Parse(value)
+			if err != nil {
+				return nil, err
+			}
+			return *u, nil
+		},
+	}
+}
+
+// RegisterDecoder registers a function converting config values to fields of type t for
+// Unmarshal and Decode, replacing any earlier decoder for t. The returned value must be
+// assignable to t. Decoders for time.Duration and url.URL are built in, and a decoder for a
+// type also applies to pointers to it
+func RegisterDecoder(t reflect.Type, decode func(string) (interface{}, error)) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	decoders[t] = decode
+}
+
+// lookupDecoder returns the registered decoder for t
+func lookupDecoder(t reflect.Type) (func(string) (interface{}, error), bool) {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	decode, exists := decoders[t]
+	return decode, exists
+}
+
+// ErrMissingKey is reported for a field tagged required whose key has no value
+var ErrMissingKey = errors.New("missing required key")
+
+// FieldError describes a struct field that could not be populated by Unmarshal
+type FieldError struct {
+	Field string // Go path of the field, e.g. Database.Port
+	Key   string // Config key the field is read from
+	Value string // Offending value, empty if the key is missing
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	if e.Value == "" {
+		return fmt.Sprintf("field %s (key %s): %v", e.Field, e.Key, e.Err)
+	}
+	return fmt.Sprintf("field %s (key %s): cannot decode %q: %v", e.Field, e.Key, e.Value, e.Err)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// Unmarshal populates the struct pointed to by v from the loaded configuration. Each exported
+// field is read from the key in its `hocon:"key"` tag, or its lowercased name if untagged, and
+// nested structs read the keys below their own key. Add ",required" to the tag to fail when
+// the key is missing, or use "-" to skip a field. Keys without a value leave fields unchanged.
+// Strings, bools, integers, floats and types with a decoder registered with RegisterDecoder
+// are supported, as are pointers to them. Slices of these read array values, and maps with
+// string keys read the keys below their key, with nested keys by their dotted path
+func Unmarshal(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("unmarshal target must be a non-nil pointer to a struct, got %T", v)
+	}
+
+	return decodeStruct(rv.Elem(), "", "", func(err *FieldError) error { return err })
+}
+
+// Decode populates the struct pointed to by v like Unmarshal, but keeps going past fields that
+// can't be populated and returns all of their errors. Each error is a *FieldError, and fields
+// tagged required whose key is missing report ErrMissingKey. It returns nil if every field decoded
+func Decode(v interface{}) []error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return []error{fmt.Errorf("decode target must be a non-nil pointer to a struct, got %T", v)}
+	}
+
+	var errs []error
+	decodeStruct(rv.Elem(), "", "", func(err *FieldError) error {
+		errs = append(errs, err)
+		return nil
+	})
+
+	return errs
+}
+
+// LoadInto loads files like Load and unmarshals the result into v. Load errors are returned
+// as-is, while unmarshalling errors are wrapped so they can be told apart
+func LoadInto(v interface{}, files ...string) error {
+	if err := Load(files...); err != nil {
+		return err
+	}
+
+	if err := Unmarshal(v); err != nil {
+		return fmt.Errorf("failed to unmarshal config: %w", err)
+	}
+
+	return nil
+}
+
+// decodeStruct populates the fields of rv from the keys below keyPrefix. Field errors are passed
+// to report, and decoding stops at the first one report returns
+func decodeStruct(rv reflect.Value, keyPrefix, fieldPrefix string, report func(*FieldError) error) error {
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name, required, skip := parseFieldTag(field)
+		if skip {
+			continue
+		}
+
+		fv := rv.Field(i)
+		key := keyPrefix + name
+		fieldName := fieldPrefix + field.Name
+
+		// Untagged embedded structs share the key space of the enclosing struct
+		if field.Anonymous && field.Tag.Get("hocon") == "" && fv.Kind() == reflect.Struct {
+			if err := decodeStruct(fv, keyPrefix, fieldPrefix, report); err != nil {
+				return err
+			}
+			continue
+		}
+
+		_, hasDecoder := lookupDecoder(fv.Type())
+		if !hasDecoder && fv.Kind() == reflect.Ptr {
+			_, hasDecoder = lookupDecoder(fv.Type().Elem())
+		}
+
+		if fv.Kind() == reflect.Struct && !hasDecoder {
+			if err := decodeStruct(fv, key+".", fieldName+".", report); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if fv.Kind() == reflect.Ptr && fv.Type().Elem().Kind() == reflect.Struct && !hasDecoder {
+			if fv.IsNil() {
+				fv.Set(reflect.New(fv.Type().Elem()))
+			}
+			if err := decodeStruct(fv.Elem(), key+".", fieldName+".", report); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Slices read arrays and maps read the keys below their key
+		if fv.Kind() == reflect.Slice && !hasDecoder {
+			if err := decodeSlice(fv, key, fieldName, required, report); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if fv.Kind() == reflect.Map && !hasDecoder {
+			if err := decodeMap(fv, key, fieldName, required, report); err != nil {
+				return err
+			}
+			continue
+		}
+
+		value, ok := lookupValue(key)
+		if !ok {
+			if required {
+				if err := report(&FieldError{Field: fieldName, Key: key, Err: ErrMissingKey}); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if err := setField(fv, value); err != nil {
+			if err := report(&FieldError{Field: fieldName, Key: key, Value: value, Err: err}); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// decodeSlice populates a slice field from an array literal or from indexed keys such as
+// key.0, key.1. Element errors name the index, and the field is only set if every element decodes
+func decodeSlice(fv reflect.Value, key, fieldName string, required bool, report func(*FieldError) error) error {
+	var elements []string
+	if value, ok := lookupValue(key); ok {
+		parsed, isArray := parseArray(value)
+		if !isArray || !isArrayKey(key) {
+			return report(&FieldError{Field: fieldName, Key: key, Value: value, Err: errors.New("not an array")})
+		}
+		elements = parsed
+	} else {
+		for i := 0; ; i++ {
+			element, ok := lookupValue(key + "." + strconv.Itoa(i))
+			if !ok {
+				break
+			}
+			elements = append(elements, element)
+		}
+
+		if len(elements) == 0 {
+			if required {
+				return report(&FieldError{Field: fieldName, Key: key, Err: ErrMissingKey})
+			}
+			return nil
+		}
+	}
+
+	slice := reflect.MakeSlice(fv.Type(), len(elements), len(elements))
+	failed := false
+	for i, element := range elements {
+		if err := setField(slice.Index(i), element); err != nil {
+			failed = true
+			fieldErr := &FieldError{Field: fmt.Sprintf("%s[%d]", fieldName, i), Key: fmt.Sprintf("%s.%d", key, i), Value: element, Err: err}
+			if err := report(fieldErr); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !failed {
+		fv.Set(slice)
+	}
+	return nil
+}
+
+// decodeMap populates a map field with string keys from the keys below key, nested keys
+// included with their dotted path. Value errors name the subkey, and the field is only set if
+// every value decodes
+func decodeMap(fv reflect.Value, key, fieldName string, required bool, report func(*FieldError) error) error {
+	mapType := fv.Type()
+	if mapType.Key().Kind() != reflect.String {
+		return report(&FieldError{Field: fieldName, Key: key, Err: fmt.Errorf("unsupported map key type %s", mapType.Key())})
+	}
+
+	children := childValues(key, true)
+	if len(children) == 0 {
+		if required {
+			return report(&FieldError{Field: fieldName, Key: key, Err: ErrMissingKey})
+		}
+		return nil
+	}
+
+	names := make([]string, 0, len(children))
+	for name := range children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	m := reflect.MakeMapWithSize(mapType, len(children))
+	failed := false
+	for _, name := range names {
+		elem := reflect.New(mapType.Elem()).Elem()
+		if err := setField(elem, children[name]); err != nil {
+			failed = true
+			fieldErr := &FieldError{Field: fmt.Sprintf("%s[%s]", fieldName, name), Key: key + "." + name, Value: children[name], Err: err}
+			if err := report(fieldErr); err != nil {
+				return err
+			}
+			continue
+		}
+		m.SetMapIndex(reflect.ValueOf(name).Convert(mapType.Key()), elem)
+	}
+
+	if !failed {
+		fv.Set(m)
+	}
+	return nil
+}
+
+// parseFieldTag returns the key name and options from a field's hocon tag
+func parseFieldTag(field reflect.StructField) (name string, required bool, skip bool) {
+	tag := field.Tag.Get("hocon")
+	if tag == "-" {
+		return "", false, true
+	}
+
+	name, options, _ := strings.Cut(tag, ",")
+	if name == "" {
+		name = strings.ToLower(field.Name)
+	}
+
+	for _, option := range strings.Split(options, ",") {
+		if strings.TrimSpace(option) == "required" {
+			required = true
+		}
+	}
+
+	return name, required, false
+}
+
+// setField converts value to the type of fv and stores it
+func setField(fv reflect.Value, value string) error {
+	if decode, exists := lookupDecoder(fv.Type()); exists {
+		decoded, err := decode(value)
+		if err != nil {
+			return err
+		}
+
+		dv := reflect.ValueOf(decoded)
+		if !dv.IsValid() || !dv.Type().AssignableTo(fv.Type()) {
+			return fmt.Errorf("decoder for %s returned %T", fv.Type(), decoded)
+		}
+		fv.Set(dv)
+		return nil
+	}
+
+	switch fv.Kind() {
+	case reflect.String:
+		fv.SetString(value)
+
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid bool")
+		}
+		fv.SetBool(b)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, fv.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid %s", fv.Type())
+		}
+		fv.SetInt(n)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, fv.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid %s", fv.Type())
+		}
+		fv.SetUint(n)
+
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, fv.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid %s", fv.Type())
+		}
+		fv.SetFloat(f)
+
+	case reflect.Ptr:
+		elem := reflect.New(fv.Type().Elem())
+		if err := setField(elem.Elem(), value); err != nil {
+			return err
+		}
+		fv.Set(elem)
+
+	default:
+		return fmt.Errorf("unsupported type %s, register a decoder for it with RegisterDecoder", fv.Type())
+	}
+
+	return nil
+}
@@ -0,0 +1,96 @@
+package hoconenv
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+)
+
+var (
+	// includeCacheDir is where the content of fetched URL includes is kept, or empty if not cached
+	includeCacheDir string
+
+	// useCacheOnFailure makes URL includes that can't be fetched load their cached copy instead
+	useCacheOnFailure bool
+)
+
+// SetIncludeCacheDir keeps a copy of every successfully fetched URL include in dir, which is
+// created if needed. An empty dir disables caching
+func SetIncludeCacheDir(dir string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	includeCacheDir = dir
+}
+
+// SetIncludeUseCacheOnFailure makes a URL include that can't be fetched, because the server is
+// unreachable or doesn't answer 200, load its copy from the include cache with a warning
+// instead of failing. The include only fails if there is no cached copy. It requires a cache
+// directory set with SetIncludeCacheDir
+func SetIncludeUseCacheOnFailure(enabled bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	useCacheOnFailure = enabled
+}
+
+// urlCachePath returns the cache file for urlStr, or false if caching is disabled
+func urlCachePath(urlStr string) (string, bool) {
+	mutex.RLock()
+	dir := includeCacheDir
+	mutex.RUnlock()
+
+	if dir == "" {
+		return "", false
+	}
+
+	sum := sha256.Sum256([]byte(urlStr))
+	return filepath.Join(dir, hex.EncodeToString(sum[:])+".conf"), true
+}
+
+// writeURLCache stores the fetched content of urlStr in the cache, warning if it can't
+func writeURLCache(urlStr string, data []byte) {
+	path, ok := urlCachePath(urlStr)
+	if !ok {
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		warn("Failed to cache URL include %s: %v", urlStr, err)
+		return
+	}
+
+	// Written to a temporary file first so a concurrent reader never sees a partial copy
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		warn("Failed to cache URL include %s: %v", urlStr, err)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		warn("Failed to cache URL include %s: %v", urlStr, err)
+	}
+}
+
+// loadURLCache loads the cached copy of urlStr in place of a fetch that failed with fetchErr.
+// It returns false if the cache isn't used or has no copy
+func loadURLCache(urlStr string, fetchErr error, currentFile string) (bool, error) {
+	mutex.RLock()
+	enabled := useCacheOnFailure
+	mutex.RUnlock()
+
+	path, ok := urlCachePath(urlStr)
+	if !enabled || !ok {
+		return false, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, nil
+	}
+
+	warn("Failed to fetch URL %s, using cached copy: %v", urlStr, fetchErr)
+	recordInclude(currentFile, urlStr)
+
+	return true, parseReader(bytes.NewReader(data), urlStr)
+}
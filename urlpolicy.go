@@ -0,0 +1,123 @@
+package hoconenv
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	// includeHosts restricts URL includes to these hosts when non-nil
+	includeHosts map[string]bool
+
+	// blockPrivateIncludes rejects URL includes that connect to private, loopback or link-local addresses
+	blockPrivateIncludes bool
+
+	// sharedAddressSpace is the carrier-grade NAT range, which net.IP.IsPrivate doesn't cover
+	sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0).To4(), Mask: net.CIDRMask(10, 32)}
+)
+
+// SetIncludeHostAllowlist restricts URL includes to the given hosts, compared case-insensitively
+// without the port. Redirects are held to the same list. An empty list allows any host
+func SetIncludeHostAllowlist(hosts []string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if len(hosts) == 0 {
+		includeHosts = nil
+		return
+	}
+
+	includeHosts = make(map[string]bool, len(hosts))
+	for _, host := range hosts {
+		includeHosts[strings.ToLower(strings.TrimSpace(host))] = true
+	}
+}
+
+// SetBlockPrivateIncludes rejects URL includes that connect to private, loopback, link-local,
+// carrier-grade NAT or unspecified addresses. The check runs on the resolved address, so DNS
+// names pointing at internal hosts are caught as well. While it is enabled, URL includes
+// connect directly and ignore proxies configured in the environment, whose address would be
+// checked instead of the target's
+func SetBlockPrivateIncludes(block bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	blockPrivateIncludes = block
+}
+
+// newHTTPClient builds the client used for URL includes, enforcing the include URL policy
+func newHTTPClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   checkDialAddress,
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.Proxy = includeProxy
+
+	return &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return fmt.Errorf("stopped after 10 redirects")
+			}
+			return checkIncludeHost(req.URL)
+		},
+	}
+}
+
+// includeProxy returns the proxy from the environment for an include request, or none while
+// private includes are blocked, so the dial check sees the target's address
+func includeProxy(req *http.Request) (*url.URL, error) {
+	mutex.RLock()
+	block := blockPrivateIncludes
+	mutex.RUnlock()
+
+	if block {
+		return nil, nil
+	}
+	return http.ProxyFromEnvironment(req)
+}
+
+// checkIncludeHost reports an error if u's host is not in the include allowlist
+func checkIncludeHost(u *url.URL) error {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	if includeHosts != nil && !includeHosts[strings.ToLower(u.Hostname())] {
+		return fmt.Errorf("host %s is not in the include allowlist", u.Hostname())
+	}
+
+	return nil
+}
+
+// checkDialAddress rejects connections to internal addresses when private includes are blocked
+func checkDialAddress(network, address string, _ syscall.RawConn) error {
+	mutex.RLock()
+	block := blockPrivateIncludes
+	mutex.RUnlock()
+
+	if !block {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || sharedAddressSpace.Contains(ip) {
+		return fmt.Errorf("connection to internal address %s is blocked", host)
+	}
+
+	return nil
+}
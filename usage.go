@@ -0,0 +1,52 @@
+package hoconenv
+
+import "sort"
+
+var (
+	trackUsage = false
+
+	// usage holds the keys, without the prefix, that were read through an accessor
+	usage = make(map[string]bool)
+)
+
+// SetTrackUsage enables recording which keys are read through GetDefaultValue, the typed
+// getters, GetJSON and Unmarshal, as reported by UnusedKeys. Reads through os.Getenv can't be
+// seen by the package and are never recorded
+func SetTrackUsage(enabled bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	trackUsage = enabled
+}
+
+// UnusedKeys returns the sorted keys, without the prefix, that are loaded but were never read
+// through an accessor since usage tracking was enabled. It returns nil if tracking is disabled
+func UnusedKeys() []string {
+	snapshot := snapshotVariables()
+
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	if !trackUsage {
+		return nil
+	}
+
+	unused := []string{}
+	for key := range snapshot {
+		if !usage[key] {
+			unused = append(unused, key)
+		}
+	}
+	sort.Strings(unused)
+
+	return unused
+}
+
+// markUsed records that key, without the prefix, was read
+func markUsed(key string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if trackUsage {
+		usage[key] = true
+	}
+}
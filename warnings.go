@@ -0,0 +1,57 @@
+package hoconenv
+
+import (
+	"fmt"
+	"strings"
+)
+
+var (
+	// warnings holds the warnings reported since the last Load started
+	warnings []string
+
+	warningsAsErrors = false
+)
+
+// SetWarningsAsErrors makes Load fail with an aggregated error if any warning was reported while
+// loading, before anything is applied to the environment. Warnings are reported for optional
+// includes that are missing or fail to load, invalid optional glob patterns, files with an
+// unknown extension, ${path} substitutions that could not be resolved and keys that collide
+// on the same environment variable
+func SetWarningsAsErrors(enabled bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	warningsAsErrors = enabled
+}
+
+// Warnings returns the warnings reported by the most recent Load
+func Warnings() []string {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return append([]string(nil), warnings...)
+}
+
+// warn prints and records a warning
+func warn(format string, args ...interface{}) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	recordWarning(format, args...)
+}
+
+// recordWarning prints and records a warning. The caller must hold the mutex
+func recordWarning(format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	fmt.Printf("Warning: %s\n", message)
+	warnings = append(warnings, message)
+}
+
+// warningsError returns the recorded warnings as a single error if warnings are treated as errors
+func warningsError() error {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	if !warningsAsErrors || len(warnings) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("load reported %d warning(s): %s", len(warnings), strings.Join(warnings, "; "))
+}